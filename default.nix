@@ -18,7 +18,7 @@ buildGoModule rec {
   buildPhase = ''
     mkdir api
     go generate
-    go build -ldflags "-s -w" nix-stored.go
+    go build -ldflags "-s -w" -o nix-stored .
   '';
 
   installPhase = ''
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/andybalholm/brotli"
+)
+
+// logEncodings maps the content codings logs can be stored with to their
+// file extension, in the order they are looked up.
+var logEncodings = []struct {
+	Encoding string
+	Ext      string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// ErrInvalidLog is returned by StoreBuildLog if the uploaded log can't be
+// decoded.
+var ErrInvalidLog = errors.New("Invalid log")
+
+var deriverRegex = regexp.MustCompile(`^[0-9a-df-np-sv-z]{32}-[A-Za-z0-9+\-._?=]+\.drv$`)
+
+// ValidDeriver reports whether deriver is the base name of a derivation
+// path, which is all nix ever asks for.
+func ValidDeriver(deriver string) bool {
+	return deriverRegex.MatchString(deriver)
+}
+
+// OpenBuildLog opens the stored log of a deriver and returns it together
+// with its content coding.
+func OpenBuildLog(dir string, deriver string) (*os.File, string, error) {
+	for _, e := range logEncodings {
+		file, err := os.Open(filepath.Join(dir, deriver+e.Ext))
+		if err == nil {
+			return file, e.Encoding, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, "", err
+		}
+	}
+	return nil, "", os.ErrNotExist
+}
+
+// StoreBuildLog stores a log uploaded with the given content coding.
+// Compressed uploads are kept as they are after checking that they
+// decompress. Uncompressed uploads are compressed with brotli.
+func StoreBuildLog(dir string, deriver string, body io.Reader, encoding string) error {
+	compress := encoding == "" || encoding == "identity"
+	ext := ".br"
+	if !compress {
+		ext = ""
+		for _, e := range logEncodings {
+			if e.Encoding == encoding {
+				ext = e.Ext
+			}
+		}
+		if ext == "" {
+			return fmt.Errorf("%w: unsupported content encoding %s", ErrInvalidLog, encoding)
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if compress {
+		w := brotli.NewWriterLevel(tmp, brotli.DefaultCompression)
+		_, err = io.Copy(w, body)
+		if err != nil {
+			return err
+		}
+		err = w.Close()
+	} else {
+		// decompress everything once to make sure we don't store garbage
+		tee := io.TeeReader(body, tmp)
+		var r io.ReadCloser
+		r, err = decodeContentEncoding(tee, encoding)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidLog, err)
+		}
+		_, err = io.Copy(io.Discard, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidLog, err)
+		}
+		_, err = io.Copy(io.Discard, tee)
+	}
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0660)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), filepath.Join(dir, deriver+ext))
+	if err != nil {
+		return err
+	}
+	// drop a previously uploaded log with another encoding
+	for _, e := range logEncodings {
+		if e.Ext != ext {
+			os.Remove(filepath.Join(dir, deriver+e.Ext))
+		}
+	}
+	return nil
+}
+
+// buildLogResponse streams a stored log. The generated response type
+// always sets Content-Encoding, which nix can't handle for plain logs.
+type buildLogResponse struct {
+	Body            io.Reader
+	ContentEncoding string
+	ContentLength   int64
+}
+
+func (response buildLogResponse) VisitGetDeriverBuildLogResponse(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if response.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", response.ContentEncoding)
+	}
+	if response.ContentLength != 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(response.ContentLength))
+	}
+	w.WriteHeader(200)
+
+	if closer, ok := response.Body.(io.ReadCloser); ok {
+		defer closer.Close()
+	}
+	_, err := io.Copy(w, response.Body)
+	return err
+}
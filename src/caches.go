@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+var cacheNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+var strictOptions = api.StrictHTTPServerOptions{
+	RequestErrorHandlerFunc: func(w http.ResponseWriter, r *http.Request, err error) {
+		slog.Warn("Request Error", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		_, e := w.Write([]byte(err.Error()))
+		if e != nil {
+			slog.Error("Couldn't write response", "error", err)
+		}
+	},
+	ResponseErrorHandlerFunc: func(w http.ResponseWriter, r *http.Request, err error) {
+		slog.Error("Response Error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, e := w.Write([]byte(err.Error()))
+		if e != nil {
+			slog.Error("Couldn't write response", "error", err)
+		}
+	},
+}
+
+// CacheRouter dispatches requests to the caches. Requests for the host name
+// of a named cache go to that cache, everything else is routed by path.
+type CacheRouter struct {
+	Caches []*Cache
+	hosts  map[string]http.Handler
+	mux    *http.ServeMux
+}
+
+// NewCacheRouter creates the directories of all caches and sets up their
+// handlers. All caches share the limit of concurrent transfers. Their
+// background work is aborted when ctx is done.
+func NewCacheRouter(ctx context.Context, s Settings, limit *semaphore.Weighted) (*CacheRouter, error) {
+	router := &CacheRouter{hosts: map[string]http.Handler{}, mux: http.NewServeMux()}
+
+	defaultCache, err := newCache(ctx, s.CacheSettings, limit)
+	if err != nil {
+		return nil, err
+	}
+	router.Caches = append(router.Caches, defaultCache)
+	router.mux.Handle("/", defaultCache.Handler(""))
+
+	for _, cs := range s.Caches {
+		cache, err := newCache(ctx, cs, limit)
+		if err != nil {
+			return nil, fmt.Errorf("Cache %s: %w", cs.Name, err)
+		}
+		router.Caches = append(router.Caches, cache)
+		prefix := "/cache/" + cs.Name
+		router.mux.Handle(prefix+"/", cache.Handler(prefix))
+
+		if cs.Host != "" {
+			host := strings.ToLower(cs.Host)
+			if _, ok := router.hosts[host]; ok {
+				return nil, fmt.Errorf("Host %s is used by more than one cache", cs.Host)
+			}
+			router.hosts[host] = cache.Handler("")
+		}
+		slog.Info("Serving cache", "name", cs.Name, "path", prefix, "host", cs.Host, "storepath", cs.StorePath)
+	}
+
+	router.mux.Handle("/metrics", BasicAuthHandler(MetricsHandler(router.Caches), s.CacheSettings.Auth()))
+	return router, nil
+}
+
+// Wait waits until the background work of all caches stopped, after the
+// context of NewCacheRouter is done.
+func (c *CacheRouter) Wait() {
+	for _, cache := range c.Caches {
+		cache.ns.workers.Wait()
+		cache.ns.proxy.Wait()
+	}
+}
+
+func (c *CacheRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	handler, ok := c.hosts[strings.ToLower(host)]
+	if ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	c.mux.ServeHTTP(w, r)
+}
+
+// Cache is a single cache with its background workers. It can be served
+// below several base urls.
+type Cache struct {
+	Settings    CacheSettings
+	Replicators []*Replicator
+	ns          NixStored
+}
+
+// storeDirs are the directories in the store path of a cache
+var storeDirs = []string{"/nar", "/log", "/realisations", "/debuginfo", "/executable", "/upstream"}
+
+func createStoreDirs(storePath string) error {
+	for _, dir := range storeDirs {
+		err := os.MkdirAll(storePath+dir, 0770)
+		if err != nil {
+			return fmt.Errorf("Couldn't create dir: %w", err)
+		}
+	}
+	return nil
+}
+
+// newCache creates the directories of a cache and starts its workers.
+func newCache(ctx context.Context, cs CacheSettings, limit *semaphore.Weighted) (*Cache, error) {
+	ns := NixStored{
+		Name:           cs.Name,
+		StorePath:      cs.StorePath,
+		CacheInfo:      cs.CacheInfo,
+		TrustedKeys:    cs.TrustedKeys,
+		IndexDebugInfo: cs.IndexDebugInfo,
+		Recompress:     cs.Recompress,
+		CacheControl:   cs.CacheControl,
+		limit:          limit,
+		workers:        newWorkers(ctx),
+		prefetches:     newJobList[*PrefetchJob](),
+		syncs:          newJobList[*SyncJob](),
+		tokens:         cs.Tokens,
+	}
+	err := createStoreDirs(cs.StorePath)
+	if err != nil {
+		return nil, err
+	}
+	err = RemoveStaleTempFiles(cs.StorePath)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't remove temporary files: %w", err)
+	}
+	for _, dir := range storeDirs {
+		err = RemoveStaleTempFiles(cs.StorePath + dir)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't remove temporary files: %w", err)
+		}
+	}
+
+	if cs.Recompress.Compression != "" {
+		queue := make(chan string, 1024)
+		ns.recompress = queue
+		ns.workers.Go(func(ctx context.Context) { ns.recompressWorker(ctx, queue) })
+	}
+
+	// syncs pull through the proxy as well, even without upstreams
+	ns.proxy = NewProxy(ctx, cs.StorePath, cs.Upstreams, cs.UpstreamNegativeTTL, ns.narStored)
+
+	if cs.LocalStore != "" {
+		ns.local = NewLocalStore(cs.LocalStore, cs.SigningKey, cs.LocalStoreCompression)
+	}
+
+	for _, target := range cs.ReplicateTo {
+		r, err := NewReplicator(cs.StorePath, target)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't create replication queue: %w", err)
+		}
+		ns.replicators = append(ns.replicators, r)
+		ns.workers.Go(r.Run)
+		slog.Info("Replicating cache", "name", cs.Name, "target", r)
+	}
+
+	return &Cache{Settings: cs, Replicators: ns.replicators, ns: ns}, nil
+}
+
+// Handler serves the cache below baseURL.
+func (c *Cache) Handler(baseURL string) http.Handler {
+	cs := c.Settings
+	apiHandler := api.NewStrictHandlerWithOptions(c.ns, []api.StrictMiddlewareFunc{PanicHandlerMiddleware(), RequestMiddleware(), BasicAuthMiddleware(cs.Auth()), LogMiddleware()}, strictOptions)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", api.HandlerWithOptions(apiHandler, api.ChiServerOptions{BaseURL: baseURL}))
+	mux.Handle(baseURL+"/buildid/", http.StripPrefix(baseURL, BasicAuthHandler(c.ns.DebuginfodHandler(), cs.Auth())))
+	return mux
+}
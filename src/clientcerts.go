@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// certFields are the values of a client certificate rules can match.
+var certFields = map[string]func(cert *x509.Certificate) []string{
+	"subject": func(cert *x509.Certificate) []string { return []string{cert.Subject.String()} },
+	"cn":      func(cert *x509.Certificate) []string { return []string{cert.Subject.CommonName} },
+	"dns":     func(cert *x509.Certificate) []string { return cert.DNSNames },
+	"email":   func(cert *x509.Certificate) []string { return cert.EmailAddresses },
+	"uri": func(cert *x509.Certificate) []string {
+		uris := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			uris[i] = u.String()
+		}
+		return uris
+	},
+	"ip": func(cert *x509.Certificate) []string {
+		ips := make([]string, len(cert.IPAddresses))
+		for i, ip := range cert.IPAddresses {
+			ips[i] = ip.String()
+		}
+		return ips
+	},
+}
+
+// certRule is a line of a client certificate file.
+type certRule struct {
+	field   string
+	pattern string
+	role    Role
+}
+
+// parseCertRule parses a line of a client certificate file: the field, a
+// glob pattern for its value and the role, separated by whitespace. The
+// pattern may be quoted if it contains whitespace, like subjects do.
+func parseCertRule(line string) (certRule, error) {
+	i, j := strings.IndexAny(line, " \t"), strings.LastIndexAny(line, " \t")
+	if i < 0 || i == j {
+		return certRule{}, fmt.Errorf("Expected field pattern role")
+	}
+	field, role := line[:i], line[j+1:]
+	rule := certRule{field: field, pattern: strings.TrimSpace(line[i:j])}
+	if _, ok := certFields[field]; !ok {
+		return certRule{}, fmt.Errorf("Unknown field %q, must be subject, cn, dns, email, uri or ip", field)
+	}
+	if len(rule.pattern) >= 2 && strings.HasPrefix(rule.pattern, `"`) && strings.HasSuffix(rule.pattern, `"`) {
+		rule.pattern = rule.pattern[1 : len(rule.pattern)-1]
+	}
+	_, err := path.Match(rule.pattern, "")
+	if err != nil || rule.pattern == "" {
+		return certRule{}, fmt.Errorf("Invalid pattern %q: %w", rule.pattern, err)
+	}
+	rule.role, err = ParseRole(role)
+	if err != nil {
+		return certRule{}, err
+	}
+	return rule, nil
+}
+
+// ClientCertRules map client certificates to roles. The file is read again
+// on Reload.
+type ClientCertRules struct {
+	file  string
+	rules atomic.Pointer[[]certRule]
+}
+
+func LoadClientCertRules(file string) (*ClientCertRules, error) {
+	c := &ClientCertRules{file: file}
+	err := c.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ClientCertRules) String() string {
+	return c.file
+}
+
+// Reload reads the file again. The old rules stay if it's invalid.
+func (c *ClientCertRules) Reload() error {
+	data, err := os.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	var rules []certRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseCertRule(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", c.file, i, err)
+		}
+		rules = append(rules, rule)
+	}
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+	c.rules.Store(&rules)
+	return nil
+}
+
+// Role returns the role of the first rule matching a verified client
+// certificate.
+func (c *ClientCertRules) Role(cert *x509.Certificate) (Role, bool) {
+	for _, rule := range *c.rules.Load() {
+		for _, value := range certFields[rule.field](cert) {
+			match, _ := path.Match(rule.pattern, value)
+			if match {
+				return rule.role, true
+			}
+		}
+	}
+	return 0, false
+}
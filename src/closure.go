@@ -0,0 +1,372 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrInvalidClosure is returned by IngestClosure if the archive can't be
+// imported.
+var ErrInvalidClosure = errors.New("Invalid closure archive")
+
+// limits of closure archives, so an upload can't fill the disk with files
+// that are never imported
+const (
+	maxClosureSize    = 64 << 30
+	maxClosureEntries = 100000
+)
+
+// zstdMagic starts every zstd frame
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// closurePaths returns the closure of a path in the cache, references first,
+// or nothing if the cache doesn't have the path. Missing references are left
+// out, the receiver may have them.
+func closurePaths(ctx context.Context, storePath string, storePathHash string) ([]syncPath, error) {
+	s := &syncer{opts: SyncOptions{Roots: []string{storePathHash}}, local: storePath}
+	paths, broken, err := s.plan(ctx, []string{storePathHash}, s.lookupLocal, func(hash string) (bool, error) { return false, nil })
+	if err != nil {
+		return nil, err
+	}
+	for hash := range broken {
+		slog.Warn("Closure is incomplete", "storepathhash", storePathHash, "missing", hash)
+	}
+	return paths, nil
+}
+
+// closureResponse streams the closure of a path as tar archive.
+type closureResponse struct {
+	storePath string
+	storeDir  string
+	paths     []syncPath
+	zstd      bool
+}
+
+func (response closureResponse) VisitGetClosureResponse(w http.ResponseWriter) error {
+	if response.zstd {
+		w.Header().Set("Content-Type", "application/zstd")
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+	}
+	w.WriteHeader(200)
+
+	// errors abort the response, so clients get a truncated archive
+	if !response.zstd {
+		return WriteClosure(w, response.storePath, response.storeDir, response.paths)
+	}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	err = WriteClosure(zw, response.storePath, response.storeDir, response.paths)
+	if err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// WriteClosure writes paths of the cache at storePath as tar archive in the
+// layout of file:// binary caches. Every narinfo comes after its NAR, listing
+// and log, so an archive that was cut off can still be imported partially.
+func WriteClosure(w io.Writer, storePath string, storeDir string, paths []syncPath) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	add := func(name string, size int64, body io.Reader) error {
+		err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: now})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, body)
+		return err
+	}
+	for _, dir := range []string{"nar/", "log/"} {
+		err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: now})
+		if err != nil {
+			return err
+		}
+	}
+	cacheInfo := fmt.Sprintf("StoreDir: %s\n", storeDir)
+	err := add("nix-cache-info", int64(len(cacheInfo)), strings.NewReader(cacheInfo))
+	if err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	for _, p := range paths {
+		dir, narFile := path.Split(path.Clean(p.info.URL))
+		if dir != "nar/" {
+			return fmt.Errorf("NAR %q isn't stored in this cache", p.info.URL)
+		}
+		if !written[narFile] {
+			written[narFile] = true
+			err = addFile(add, storePath+"/nar/"+narFile, "nar/"+narFile)
+			if err != nil {
+				return err
+			}
+		}
+		err = addFile(add, fmt.Sprintf("%s/%s.ls", storePath, p.hash), p.hash+".ls")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if ValidDeriver(p.info.Deriver) && !written[p.info.Deriver] {
+			written[p.info.Deriver] = true
+			err = addLog(add, storePath, p.info.Deriver)
+			if err != nil {
+				return err
+			}
+		}
+		err = add(p.hash+".narinfo", int64(len(p.data)), bytes.NewReader(p.data))
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addFile(add func(name string, size int64, body io.Reader) error, filename string, name string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return add(name, info.Size(), file)
+}
+
+// addLog adds the log of a deriver uncompressed, like nix stores logs in
+// file:// binary caches.
+func addLog(add func(name string, size int64, body io.Reader) error, storePath string, deriver string) error {
+	file, encoding, err := OpenBuildLog(storePath+"/log", deriver)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := decodeContentEncoding(file, encoding)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	log, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return add("log/"+deriver, int64(len(log)), bytes.NewReader(log))
+}
+
+// IngestClosure imports a tar archive as written by WriteClosure, optionally
+// compressed with zstd, into the cache at storePath. The archive is unpacked
+// and checked completely before anything is imported, so nothing is imported
+// if a NAR doesn't match its narinfo or a closure is incomplete. It returns
+// the imported paths, references first.
+func IngestClosure(ctx context.Context, storePath string, storeDir string, archive io.Reader, narStored func(narFile string)) ([]string, error) {
+	tmp, err := os.MkdirTemp(storePath+"/upstream", ".closure-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	src := cacheDir{path: tmp, plainLogs: true}
+	dst := cacheDir{path: storePath}
+
+	err = unpackClosure(archive, tmp, maxClosureSize, maxClosureEntries)
+	if err != nil {
+		return nil, err
+	}
+	sourceStoreDir, err := readStoreDir(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidClosure, err)
+	}
+	if sourceStoreDir != storeDir {
+		return nil, fmt.Errorf("%w: it's for %s, not %s", ErrInvalidClosure, sourceStoreDir, storeDir)
+	}
+
+	candidates, err := listNarInfos(tmp)
+	if err != nil {
+		return nil, err
+	}
+	s := &syncer{opts: SyncOptions{Pull: true}, local: tmp}
+	has := func(hash string) (bool, error) {
+		_, err := os.Stat(fmt.Sprintf("%s/%s.narinfo", storePath, hash))
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	paths, broken, err := s.plan(ctx, candidates, func(hash string) (*syncPath, error) {
+		p, err := s.lookupLocal(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidClosure, err)
+		}
+		return p, nil
+	}, has)
+	if err != nil {
+		return nil, err
+	}
+	for hash := range broken {
+		return nil, fmt.Errorf("%w: the reference %s is missing", ErrInvalidClosure, hash)
+	}
+
+	// check everything before the first path shows up in the cache
+	for _, p := range paths {
+		dir, narFile := path.Split(path.Clean(p.info.URL))
+		if _, ok := parseNarFile(narFile); !ok || dir != "nar/" {
+			return nil, fmt.Errorf("%w: unsupported NAR url %q", ErrInvalidClosure, p.info.URL)
+		}
+		_, err = os.Stat(storePath + "/nar/" + narFile)
+		if err == nil {
+			continue
+		}
+		nar, err := os.Open(tmp + "/nar/" + narFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: the NAR of %s is missing", ErrInvalidClosure, p.info.StorePath)
+		}
+		err = checkNar(bufio.NewReader(nar), p.info)
+		nar.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidClosure, err)
+		}
+		listing, err := os.ReadFile(fmt.Sprintf("%s/%s.ls", tmp, p.hash))
+		if err == nil {
+			_, err = ParseFileListing(listing)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid listing of %s: %w", ErrInvalidClosure, p.info.StorePath, err)
+			}
+		}
+	}
+
+	// the checked NARs are moved instead of copied
+	var imported []string
+	for _, p := range paths {
+		if ctx.Err() != nil {
+			return imported, ctx.Err()
+		}
+		narFile := path.Base(p.info.URL)
+		_, err = os.Stat(storePath + "/nar/" + narFile)
+		if errors.Is(err, os.ErrNotExist) {
+			err = os.Chmod(tmp+"/nar/"+narFile, 0660)
+			if err == nil {
+				err = os.Rename(tmp+"/nar/"+narFile, storePath+"/nar/"+narFile)
+			}
+			if err == nil && narStored != nil {
+				narStored(narFile)
+			}
+		}
+		if err == nil {
+			err = copyCachePath(src, dst, p, nil)
+		}
+		if err != nil {
+			return imported, err
+		}
+		slog.Info("Imported path", "storepath", p.info.StorePath)
+		imported = append(imported, p.info.StorePath)
+	}
+	return imported, nil
+}
+
+// unpackClosure unpacks the files of a binary cache from a tar archive to
+// dir. Other files are skipped. It fails if the files are bigger than
+// maxSize or the archive has more than maxEntries entries.
+func unpackClosure(archive io.Reader, dir string, maxSize int64, maxEntries int) error {
+	br := bufio.NewReader(archive)
+	magic, _ := br.Peek(len(zstdMagic))
+	var r io.Reader = br
+	if bytes.Equal(magic, zstdMagic) {
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidClosure, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	for _, sub := range []string{"/nar", "/log"} {
+		err := os.Mkdir(dir+sub, 0770)
+		if err != nil {
+			return err
+		}
+	}
+
+	tr := tar.NewReader(r)
+	var size int64
+	for entries := 1; ; entries++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidClosure, err)
+		}
+		if entries > maxEntries {
+			return fmt.Errorf("%w: it has more than %d entries", ErrInvalidClosure, maxEntries)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if !validClosureFile(name) {
+			slog.Debug("Skipping unknown file in closure archive", "file", hdr.Name)
+			continue
+		}
+		size += hdr.Size
+		if size > maxSize {
+			return fmt.Errorf("%w: it's bigger than %d bytes", ErrInvalidClosure, maxSize)
+		}
+		file, err := os.OpenFile(dir+"/"+name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+		if err != nil {
+			if errors.Is(err, os.ErrExist) {
+				return fmt.Errorf("%w: %s is in it twice", ErrInvalidClosure, name)
+			}
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("%w: %w", ErrInvalidClosure, err)
+		}
+		err = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// validClosureFile reports whether name is a file of a binary cache that is
+// imported from closure archives.
+func validClosureFile(name string) bool {
+	dir, file := path.Split(name)
+	switch dir {
+	case "":
+		if file == "nix-cache-info" {
+			return true
+		}
+		hash, ok := strings.CutSuffix(file, ".narinfo")
+		if !ok {
+			hash, ok = strings.CutSuffix(file, ".ls")
+		}
+		return ok && storePathHashRegex.MatchString(hash)
+	case "nar/":
+		_, ok := parseNarFile(file)
+		return ok
+	case "log/":
+		return ValidDeriver(file)
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestUnpackClosureLimits(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, hash := range []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "cccccccccccccccccccccccccccccccc"} {
+		data := []byte("StorePath: /nix/store/" + hash + "-pkg\n")
+		err := tw.WriteHeader(&tar.Header{Name: hash + ".narinfo", Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(3 * len("StorePath: /nix/store/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-pkg\n"))
+
+	err = unpackClosure(bytes.NewReader(archive.Bytes()), t.TempDir(), size, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unpackClosure(bytes.NewReader(archive.Bytes()), t.TempDir(), size, 2)
+	if !errors.Is(err, ErrInvalidClosure) {
+		t.Errorf("got %v with too many entries", err)
+	}
+	err = unpackClosure(bytes.NewReader(archive.Bytes()), t.TempDir(), size-1, 3)
+	if !errors.Is(err, ErrInvalidClosure) {
+		t.Errorf("got %v with too many bytes", err)
+	}
+}
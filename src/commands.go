@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+// commands are the subcommands next to serving, like nix-stored sync.
+var commands = map[string]func(s Settings, args []string) int{
+	"sync":     syncCommand,
+	"prefetch": prefetchCommand,
+	"import":   importCommand,
+	"export":   exportCommand,
+	"user":     userCommand,
+	"token":    tokenCommand,
+}
+
+// runCommand runs a subcommand and returns its exit code. Logs go to
+// stderr, so the output of a command can be piped.
+func runCommand(name string, args []string) int {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	command, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		fmt.Fprintf(os.Stderr, "Unknown command %q, available are: %s\n", name, strings.Join(names, ", "))
+		return 2
+	}
+	s, err := SettingsFromEnv()
+	if err != nil {
+		slog.Error("Couldn't load settings", "error", err)
+		return 1
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: s.LogLevel})))
+	return command(s, args)
+}
+
+// commandContext is canceled by SIGINT and SIGTERM.
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+// cacheByName returns the settings of a named cache, or of the default
+// cache if name is empty.
+func (s Settings) cacheByName(name string) (CacheSettings, error) {
+	if name == "" {
+		return s.CacheSettings, nil
+	}
+	for _, cache := range s.Caches {
+		if cache.Name == name {
+			return cache, nil
+		}
+	}
+	return CacheSettings{}, fmt.Errorf("Unknown cache %q", name)
+}
+
+// commandNarStored indexes the build ids of stored NARs right away, as
+// commands don't wait for background work.
+func commandNarStored(cs CacheSettings) func(narFile string) {
+	return func(narFile string) {
+		if cs.IndexDebugInfo {
+			err := IndexBuildIDs(cs.StorePath, narFile)
+			if err != nil {
+				slog.Warn("Couldn't index build ids", "file", narFile, "error", err)
+			}
+		}
+	}
+}
+
+// stringsFlag is a flag that can be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func syncCommand(s Settings, args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: nix-stored sync [flags] <remote>")
+		fmt.Fprintln(flags.Output(), "Copies the paths missing in a cache or the remote cache to the other one.")
+		flags.PrintDefaults()
+	}
+	cacheName := flags.String("cache", "", "name of the cache, the default cache if empty")
+	direction := flags.String("direction", "both", "push, pull or both")
+	system := flags.String("system", "", "only copy paths built for this system")
+	name := flags.String("name", "", "only copy paths whose name matches this glob pattern")
+	var roots stringsFlag
+	flags.Var(&roots, "root", "only copy the closure of this store path, can be given multiple times")
+	dryRun := flags.Bool("dry-run", false, "only print what would be copied")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	if *direction != "push" && *direction != "pull" && *direction != "both" {
+		slog.Error("Invalid direction, must be push, pull or both", "direction", *direction)
+		return 2
+	}
+	cs, err := s.cacheByName(*cacheName)
+	if err != nil {
+		slog.Error("Couldn't sync", "error", err)
+		return 2
+	}
+	remotes, err := ParseUpstreams(flags.Arg(0))
+	if err != nil || len(remotes) != 1 {
+		slog.Error("Invalid remote", "error", err)
+		return 2
+	}
+	opts := SyncOptions{
+		Remote: remotes[0],
+		Push:   *direction == "push" || *direction == "both",
+		Pull:   *direction == "pull" || *direction == "both",
+		System: *system,
+		Name:   *name,
+		Roots:  roots,
+		DryRun: *dryRun,
+	}
+	err = opts.Validate()
+	if err != nil {
+		slog.Error("Couldn't sync", "error", err)
+		return 2
+	}
+
+	// temporary files are left alone, the daemon may be writing them
+	err = createStoreDirs(cs.StorePath)
+	if err != nil {
+		slog.Error("Couldn't sync", "error", err)
+		return 1
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	proxy := NewProxy(ctx, cs.StorePath, nil, 0, commandNarStored(cs))
+	result, err := Sync(ctx, proxy, opts, nil)
+	proxy.Wait()
+	for _, storePath := range result.Pushed {
+		fmt.Println("push", storePath)
+	}
+	for _, storePath := range result.Pulled {
+		fmt.Println("pull", storePath)
+	}
+	for _, storePath := range result.Failed {
+		fmt.Println("failed", storePath)
+	}
+	if err != nil {
+		slog.Error("Couldn't sync", "error", err)
+		return 1
+	}
+	if len(result.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func prefetchCommand(s Settings, args []string) int {
+	flags := flag.NewFlagSet("prefetch", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: nix-stored prefetch [flags] <store path>...")
+		fmt.Fprintln(flags.Output(), "Fetches the closures of store paths from the upstreams of a cache.")
+		flags.PrintDefaults()
+	}
+	cacheName := flags.String("cache", "", "name of the cache, the default cache if empty")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cs, err := s.cacheByName(*cacheName)
+	if err != nil {
+		slog.Error("Couldn't prefetch", "error", err)
+		return 2
+	}
+	err = createStoreDirs(cs.StorePath)
+	if err != nil {
+		slog.Error("Couldn't prefetch", "error", err)
+		return 1
+	}
+	ctx, cancel := commandContext()
+	defer cancel()
+	w := newWorkers(ctx)
+	proxy := NewProxy(ctx, cs.StorePath, cs.Upstreams, 0, commandNarStored(cs))
+	job, err := StartPrefetch(w, proxy, flags.Args(), func(storePath string) {
+		fmt.Println(storePath)
+	})
+	if err != nil {
+		slog.Error("Couldn't prefetch", "error", err)
+		return 2
+	}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			slog.Info("Canceling prefetch")
+			job.Cancel()
+			<-job.Done()
+			done = true
+		case <-job.Done():
+			done = true
+		case <-ticker.C:
+			status := job.Status()
+			slog.Info("Prefetching", "state", status.State, "fetched", status.Fetched, "total", status.Total, "failed", len(status.Failed))
+		}
+	}
+	w.Wait()
+	proxy.Wait()
+
+	status := job.Status()
+	for _, storePath := range status.Failed {
+		slog.Error("Couldn't fetch path", "storepath", storePath)
+	}
+	if status.Error != nil {
+		slog.Error("Couldn't prefetch", "error", *status.Error)
+	}
+	if status.State != api.PrefetchStatusStateDone || len(status.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func importCommand(s Settings, args []string) int {
+	return fileCacheCommand(s, "import", args)
+}
+
+func exportCommand(s Settings, args []string) int {
+	return fileCacheCommand(s, "export", args)
+}
+
+// fileCacheCommand imports from or exports to a file:// binary cache.
+func fileCacheCommand(s Settings, name string, args []string) int {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		if name == "import" {
+			fmt.Fprintln(flags.Output(), "Usage: nix-stored import [flags] <file:// binary cache | closure archive | ->")
+			fmt.Fprintln(flags.Output(), "Copies the paths of a binary cache directory, as written by nix copy, into a cache.")
+			fmt.Fprintln(flags.Output(), "Closure archives are imported completely, - reads one from stdin.")
+		} else {
+			fmt.Fprintln(flags.Output(), "Usage: nix-stored export [flags] <file:// binary cache>")
+			fmt.Fprintln(flags.Output(), "Copies the paths of a cache into a binary cache directory nix can copy from.")
+		}
+		flags.PrintDefaults()
+	}
+	cacheName := flags.String("cache", "", "name of the cache, the default cache if empty")
+	system := flags.String("system", "", "only copy paths built for this system")
+	pathName := flags.String("name", "", "only copy paths whose name matches this glob pattern")
+	var roots stringsFlag
+	flags.Var(&roots, "root", "only copy the closure of this store path, can be given multiple times")
+	dryRun := flags.Bool("dry-run", false, "only print what would be copied")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	cs, err := s.cacheByName(*cacheName)
+	if err != nil {
+		slog.Error("Couldn't "+name, "error", err)
+		return 2
+	}
+	if name == "import" && isClosureArchive(flags.Arg(0)) {
+		return ingestCommand(cs, flags.Arg(0))
+	}
+	dir, err := ParseFileCache(flags.Arg(0))
+	if err != nil {
+		slog.Error("Invalid binary cache", "cache", flags.Arg(0), "error", err)
+		return 2
+	}
+	opts := SyncOptions{System: *system, Name: *pathName, Roots: roots, DryRun: *dryRun}
+	err = createStoreDirs(cs.StorePath)
+	if err != nil {
+		slog.Error("Couldn't "+name, "error", err)
+		return 1
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	failed := 0
+	copied := func(storePath string, err error) {
+		if err != nil {
+			fmt.Println("failed", storePath)
+			failed++
+			return
+		}
+		fmt.Println(name, storePath)
+	}
+	if name == "import" {
+		err = ImportFileCache(ctx, cs.StorePath, cs.CacheInfo.StoreDir, dir, opts, copied, commandNarStored(cs))
+	} else {
+		err = ExportFileCache(ctx, cs.StorePath, cs.CacheInfo.StoreDir, dir, opts, copied)
+	}
+	if err != nil {
+		slog.Error("Couldn't "+name, "error", err)
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// isClosureArchive reports whether arg is stdin or a file rather than a
+// binary cache directory.
+func isClosureArchive(arg string) bool {
+	if arg == "-" {
+		return true
+	}
+	info, err := os.Stat(arg)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// ingestCommand imports a closure archive.
+func ingestCommand(cs CacheSettings, archive string) int {
+	err := createStoreDirs(cs.StorePath)
+	if err != nil {
+		slog.Error("Couldn't import", "error", err)
+		return 1
+	}
+	r := os.Stdin
+	if archive != "-" {
+		r, err = os.Open(archive)
+		if err != nil {
+			slog.Error("Couldn't import", "error", err)
+			return 1
+		}
+		defer r.Close()
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	imported, err := IngestClosure(ctx, cs.StorePath, cs.CacheInfo.StoreDir, r, commandNarStored(cs))
+	for _, storePath := range imported {
+		fmt.Println("import", storePath)
+	}
+	if err != nil {
+		slog.Error("Couldn't import", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// userCommand manages the users of a user file.
+func userCommand(s Settings, args []string) int {
+	usage := func(flags *flag.FlagSet) {
+		fmt.Fprintln(flags.Output(), "Usage: nix-stored user add|remove|passwd [flags] <name>")
+		fmt.Fprintln(flags.Output(), "Manages the users of the user file of a cache. Passwords are read from stdin.")
+		flags.PrintDefaults()
+	}
+	flags := flag.NewFlagSet("user", flag.ContinueOnError)
+	flags.Usage = func() { usage(flags) }
+	cacheName := flags.String("cache", "", "name of the cache, the default cache if empty")
+	file := flags.String("file", "", "the user file, USERS_FILE of the cache if empty")
+	roleName := flags.String("role", "", "role of the user, read, write or admin, read for new users")
+	scheme := flags.String("hash", "bcrypt", "how passwords are hashed, bcrypt or argon2id")
+	if len(args) == 0 {
+		usage(flags)
+		return 2
+	}
+	action := args[0]
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (action != "add" && action != "remove" && action != "passwd") {
+		flags.Usage()
+		return 2
+	}
+	name := flags.Arg(0)
+	if !userNameRegex.MatchString(name) {
+		slog.Error("Invalid user name", "name", name)
+		return 2
+	}
+	var role Role
+	if *roleName != "" {
+		role, err = ParseRole(*roleName)
+		if err != nil {
+			slog.Error("Couldn't change user", "error", err)
+			return 2
+		}
+	}
+
+	if *file == "" {
+		cs, err := s.cacheByName(*cacheName)
+		if err != nil {
+			slog.Error("Couldn't change user", "error", err)
+			return 2
+		}
+		if cs.Users == nil {
+			slog.Error("The cache has no user file, set USERS_FILE or -file")
+			return 2
+		}
+		*file = cs.Users.file
+	}
+
+	var hash string
+	if action != "remove" {
+		if term, err := os.Stdin.Stat(); err == nil && term.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprint(os.Stderr, "Password: ")
+		}
+		pass, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		pass = strings.TrimRight(pass, "\r\n")
+		if pass == "" {
+			slog.Error("Couldn't read password from stdin", "error", err)
+			return 1
+		}
+		hash, err = HashPassword(pass, *scheme)
+		if err != nil {
+			slog.Error("Couldn't hash password", "error", err)
+			return 2
+		}
+	}
+
+	err = updateUserFile(*file, name, func(entry *userEntry) (*userEntry, error) {
+		switch {
+		case action == "add" && entry != nil:
+			return nil, fmt.Errorf("User %s exists already", name)
+		case action != "add" && entry == nil:
+			return nil, fmt.Errorf("Unknown user %s", name)
+		case action == "remove":
+			return nil, nil
+		case action == "add":
+			entry = &userEntry{name: name, role: RoleRead}
+		}
+		entry.hash = hash
+		if role != 0 {
+			entry.role = role
+		}
+		return entry, nil
+	})
+	if err != nil {
+		slog.Error("Couldn't change user", "error", err)
+		return 1
+	}
+	slog.Info("Changed user file, send SIGHUP to running daemons to apply it", "file", *file, "user", name, "action", action)
+	return 0
+}
+
+func tokenCommand(s Settings, args []string) int {
+	usage := func(flags *flag.FlagSet) {
+		fmt.Fprintln(flags.Output(), "Usage: nix-stored token create|list|revoke [flags] [id]")
+		fmt.Fprintln(flags.Output(), "Manages API tokens. create prints the new token, it's not shown again.")
+		flags.PrintDefaults()
+	}
+	flags := flag.NewFlagSet("token", flag.ContinueOnError)
+	flags.Usage = func() { usage(flags) }
+	cacheName := flags.String("cache", "", "the only cache the token is valid for, all caches if empty")
+	scopes := flags.String("scope", "read", "comma separated scopes of the token: read, write, delete, admin")
+	name := flags.String("name", "", "glob pattern the names of uploaded paths must match, without the hash")
+	ttl := flags.Duration("ttl", 24*time.Hour, "how long the token is valid")
+	description := flags.String("description", "", "what the token is for")
+	if len(args) == 0 {
+		usage(flags)
+		return 2
+	}
+	action := args[0]
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
+	if *cacheName != "" {
+		_, err = s.cacheByName(*cacheName)
+		if err != nil {
+			slog.Error("Couldn't use cache", "error", err)
+			return 2
+		}
+	}
+
+	switch {
+	case action == "create" && flags.NArg() == 0:
+		req := api.TokenRequest{Cache: cacheName}
+		req.Scopes, err = ParseTokenScopes(*scopes)
+		if err != nil {
+			slog.Error("Couldn't create token", "error", err)
+			return 2
+		}
+		ttlString := ttl.String()
+		req.Ttl = &ttlString
+		if *name != "" {
+			req.Name = name
+		}
+		if *description != "" {
+			req.Description = description
+		}
+		secret, info, err := s.Tokens.Create(req)
+		if err != nil {
+			slog.Error("Couldn't create token", "error", err)
+			return 1
+		}
+		slog.Info("Created token", "id", info.Id, "scopes", info.Scopes, "expires", info.Expires)
+		fmt.Println(secret)
+	case action == "list" && flags.NArg() == 0:
+		infos, err := s.Tokens.List(*cacheName)
+		if err != nil {
+			slog.Error("Couldn't list tokens", "error", err)
+			return 1
+		}
+		for _, info := range infos {
+			scopes := make([]string, len(info.Scopes))
+			for i, scope := range info.Scopes {
+				scopes[i] = string(scope)
+			}
+			line := fmt.Sprintf("%s %s expires=%s", info.Id, strings.Join(scopes, ","), info.Expires.Format(time.RFC3339))
+			if info.Cache != nil {
+				line += " cache=" + *info.Cache
+			}
+			if info.Name != nil {
+				line += " name=" + *info.Name
+			}
+			if info.Description != nil {
+				line += fmt.Sprintf(" description=%q", *info.Description)
+			}
+			fmt.Println(line)
+		}
+	case action == "revoke" && flags.NArg() == 1:
+		err = s.Tokens.Revoke(flags.Arg(0), *cacheName)
+		if err != nil {
+			slog.Error("Couldn't revoke token", "id", flags.Arg(0), "error", err)
+			return 1
+		}
+		slog.Info("Revoked token", "id", flags.Arg(0))
+	default:
+		flags.Usage()
+		return 2
+	}
+	return 0
+}
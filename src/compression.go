@@ -0,0 +1,56 @@
+package main
+
+import (
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// narExtensions are the file extensions of compressed NARs, see the
+// compression parameter in the api. Only compressions decompressNar can read
+// are accepted.
+var narExtensions = []string{"br", "bz2", "zst", "xz"}
+
+var fileHashRegex = regexp.MustCompile(`^[0-9a-df-np-sv-z]{32,128}$`)
+
+// ValidNarFile reports whether a NAR file name is one nix would produce.
+// compression is empty for uncompressed NARs.
+func ValidNarFile(fileHash string, compression string) bool {
+	if !fileHashRegex.MatchString(fileHash) {
+		return false
+	}
+	return compression == "" || slices.Contains(narExtensions, compression)
+}
+
+// decompressNar wraps r to decompress a NAR. compression is either the
+// Compression field of a narinfo or the file extension of the NAR.
+func decompressNar(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "none", "":
+		return io.NopCloser(r), nil
+	case "xz":
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case "bzip2", "bz2":
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case "zstd", "zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression: %s", compression)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// the parts of the nix daemon worker protocol we speak, see
+// src/libstore/worker-protocol.hh of nix
+const (
+	daemonMagic1         = 0x6e697863
+	daemonMagic2         = 0x6478696f
+	daemonProtocol       = 1<<8 | 23
+	daemonMinProtocol    = 1<<8 | 17
+	opQueryPathInfo      = 26
+	opQueryPathFromHash  = 29
+	stderrNext           = 0x6f6c6d67
+	stderrLast           = 0x616c7473
+	stderrError          = 0x63787470
+	stderrStartActivity  = 0x53545254
+	stderrStopActivity   = 0x53544f50
+	stderrResult         = 0x52534c54
+	daemonMaxString      = 1 << 20
+	daemonMaxIdleConns   = 4
+	daemonRequestTimeout = time.Minute
+)
+
+// PathInfo is what the nix daemon knows about a valid store path.
+type PathInfo struct {
+	Path       string
+	Deriver    string
+	NarHash    string
+	References []string
+	NarSize    uint64
+	Sigs       []string
+	CA         string
+}
+
+// DaemonClient queries the nix daemon over its unix socket. Connections are
+// reused.
+type DaemonClient struct {
+	dial func() (net.Conn, error)
+
+	mu   sync.Mutex
+	idle []*daemonConn
+}
+
+func NewDaemonClient(socket string) *DaemonClient {
+	return &DaemonClient{dial: func() (net.Conn, error) {
+		return net.DialTimeout("unix", socket, 10*time.Second)
+	}}
+}
+
+type daemonConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	err  error
+}
+
+// QueryPathFromHashPart returns the store path with the given hash, or ""
+// if there is none.
+func (d *DaemonClient) QueryPathFromHashPart(hashPart string) (string, error) {
+	var storePath string
+	err := d.do(func(c *daemonConn) {
+		c.writeUint64(opQueryPathFromHash)
+		c.writeString(hashPart)
+		c.processStderr()
+		storePath = c.readString()
+	})
+	return storePath, err
+}
+
+// QueryPathInfo returns the metadata of a store path, or nil if the path
+// isn't valid.
+func (d *DaemonClient) QueryPathInfo(storePath string) (*PathInfo, error) {
+	var info *PathInfo
+	err := d.do(func(c *daemonConn) {
+		c.writeUint64(opQueryPathInfo)
+		c.writeString(storePath)
+		c.processStderr()
+		info = nil
+		if c.readUint64() == 0 {
+			return
+		}
+		info = &PathInfo{Path: storePath}
+		info.Deriver = c.readString()
+		info.NarHash = c.readString()
+		info.References = c.readStrings()
+		c.readUint64() // registration time
+		info.NarSize = c.readUint64()
+		c.readUint64() // ultimate
+		info.Sigs = c.readStrings()
+		info.CA = c.readString()
+	})
+	return info, err
+}
+
+// do runs a request on an idle or new connection. Connections are only
+// reused if the request went through without an error. The daemon may have
+// closed an idle connection, so a failed request on one is retried once.
+func (d *DaemonClient) do(request func(c *daemonConn)) error {
+	c, reused, err := d.get()
+	if err != nil {
+		return err
+	}
+	c.conn.SetDeadline(time.Now().Add(daemonRequestTimeout))
+	request(c)
+	if c.err == nil {
+		c.flush()
+	}
+	if c.err != nil {
+		c.conn.Close()
+		if reused {
+			return d.do(request)
+		}
+		return fmt.Errorf("Nix daemon: %w", c.err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.idle) < daemonMaxIdleConns {
+		d.idle = append(d.idle, c)
+	} else {
+		c.conn.Close()
+	}
+	return nil
+}
+
+func (d *DaemonClient) get() (*daemonConn, bool, error) {
+	d.mu.Lock()
+	if len(d.idle) > 0 {
+		c := d.idle[len(d.idle)-1]
+		d.idle = d.idle[:len(d.idle)-1]
+		d.mu.Unlock()
+		return c, true, nil
+	}
+	d.mu.Unlock()
+
+	conn, err := d.dial()
+	if err != nil {
+		return nil, false, fmt.Errorf("Couldn't connect to the nix daemon: %w", err)
+	}
+	c := &daemonConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	conn.SetDeadline(time.Now().Add(daemonRequestTimeout))
+	c.handshake()
+	if c.err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("Nix daemon handshake failed: %w", c.err)
+	}
+	return c, false, nil
+}
+
+func (c *daemonConn) handshake() {
+	c.writeUint64(daemonMagic1)
+	c.flush()
+	if c.readUint64() != daemonMagic2 && c.err == nil {
+		c.err = fmt.Errorf("Not a nix daemon")
+		return
+	}
+	version := c.readUint64()
+	if version>>8 != daemonProtocol>>8 || version < daemonMinProtocol {
+		if c.err == nil {
+			c.err = fmt.Errorf("Unsupported protocol version %d.%d", version>>8, version&0xff)
+		}
+		return
+	}
+	c.writeUint64(daemonProtocol)
+	c.writeUint64(0) // no cpu affinity
+	c.writeUint64(0) // don't reserve space
+	c.flush()
+	c.processStderr()
+}
+
+// processStderr reads the log messages the daemon sends before the reply.
+// An error message ends the request.
+func (c *daemonConn) processStderr() {
+	c.flush()
+	for c.err == nil {
+		switch msg := c.readUint64(); msg {
+		case stderrLast:
+			return
+		case stderrNext:
+			c.readString()
+		case stderrError:
+			message := c.readString()
+			c.readUint64() // exit status
+			if c.err == nil {
+				c.err = fmt.Errorf("%s", message)
+			}
+		case stderrStartActivity:
+			c.readUint64() // id
+			c.readUint64() // level
+			c.readUint64() // type
+			c.readString()
+			c.readFields()
+			c.readUint64() // parent
+		case stderrStopActivity:
+			c.readUint64()
+		case stderrResult:
+			c.readUint64() // id
+			c.readUint64() // type
+			c.readFields()
+		default:
+			if c.err == nil {
+				c.err = fmt.Errorf("Unexpected message %x", msg)
+			}
+		}
+	}
+}
+
+func (c *daemonConn) readFields() {
+	n := c.readUint64()
+	for i := uint64(0); i < n && c.err == nil; i++ {
+		if c.readUint64() == 0 {
+			c.readUint64()
+		} else {
+			c.readString()
+		}
+	}
+}
+
+func (c *daemonConn) writeUint64(n uint64) {
+	if c.err != nil {
+		return
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], n)
+	_, c.err = c.w.Write(buf[:])
+}
+
+func (c *daemonConn) writeString(s string) {
+	c.writeUint64(uint64(len(s)))
+	if c.err != nil {
+		return
+	}
+	var zeros [8]byte
+	_, c.err = c.w.Write(append([]byte(s), zeros[:padding(uint64(len(s)))]...))
+}
+
+func (c *daemonConn) flush() {
+	if c.err == nil {
+		c.err = c.w.Flush()
+	}
+}
+
+func (c *daemonConn) readUint64() uint64 {
+	if c.err != nil {
+		return 0
+	}
+	var buf [8]byte
+	_, c.err = io.ReadFull(c.r, buf[:])
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+func (c *daemonConn) readString() string {
+	size := c.readUint64()
+	if c.err != nil {
+		return ""
+	}
+	if size > daemonMaxString {
+		c.err = fmt.Errorf("String too long")
+		return ""
+	}
+	buf := make([]byte, int64(size)+padding(size))
+	_, c.err = io.ReadFull(c.r, buf)
+	return string(buf[:size])
+}
+
+func (c *daemonConn) readStrings() []string {
+	n := c.readUint64()
+	var list []string
+	for i := uint64(0); i < n && c.err == nil; i++ {
+		list = append(list, c.readString())
+	}
+	return list
+}
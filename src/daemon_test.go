@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testStorePath = "/nix/store/p4pclmv1gyja5kzc26npqpia1qqxrf0l-ruby-2.7.3"
+
+var testPathInfo = PathInfo{
+	Path:       testStorePath,
+	Deriver:    "/nix/store/bcbzl5f2a6sjy9bg4ip0jhcyscs8zfy4-ruby-2.7.3.drv",
+	NarHash:    "sha256:1impfw8zdgisxkghq9a3q7cn7jb9zyzgxdydiamp8z2nlyyl0h5h",
+	References: []string{testStorePath, "/nix/store/0d71ygfwbmy1xjlbj1v027dfmy9cqavy-libffi-3.3"},
+	NarSize:    1234,
+	Sigs:       []string{"cache.nixos.org-1:GrGV/Ls10TzoOaCnrcAqmPbKXFLLSBDeGNh5EQGKyuGA4K1wv1LcRVb6/sU+NAPK8lDiam8XcdJzUngmdhfTBQ=="},
+}
+
+// fakeDaemon answers the requests of a DaemonClient like the nix daemon,
+// knowing only testPathInfo. Querying failPath sends an error.
+func fakeDaemon(conn net.Conn, failPath string) {
+	defer conn.Close()
+	c := &daemonConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if c.readUint64() != daemonMagic1 {
+		return
+	}
+	c.writeUint64(daemonMagic2)
+	c.writeUint64(daemonProtocol)
+	c.flush()
+	c.readUint64() // client version
+	c.readUint64() // cpu affinity
+	c.readUint64() // reserve space
+	c.writeUint64(stderrLast)
+	c.flush()
+
+	for c.err == nil {
+		switch c.readUint64() {
+		case opQueryPathFromHash:
+			hashPart := c.readString()
+			c.writeUint64(stderrNext)
+			c.writeString("looking up " + hashPart)
+			c.writeUint64(stderrLast)
+			if strings.HasPrefix(testStorePath, "/nix/store/"+hashPart+"-") {
+				c.writeString(testStorePath)
+			} else {
+				c.writeString("")
+			}
+		case opQueryPathInfo:
+			storePath := c.readString()
+			if storePath == failPath {
+				c.writeUint64(stderrError)
+				c.writeString("path '" + storePath + "' is broken")
+				c.writeUint64(1)
+				c.flush()
+				return
+			}
+			c.writeUint64(stderrLast)
+			if storePath != testStorePath {
+				c.writeUint64(0)
+				break
+			}
+			c.writeUint64(1)
+			c.writeString(testPathInfo.Deriver)
+			c.writeString(testPathInfo.NarHash)
+			c.writeUint64(uint64(len(testPathInfo.References)))
+			for _, ref := range testPathInfo.References {
+				c.writeString(ref)
+			}
+			c.writeUint64(1700000000) // registration time
+			c.writeUint64(testPathInfo.NarSize)
+			c.writeUint64(0) // ultimate
+			c.writeUint64(uint64(len(testPathInfo.Sigs)))
+			for _, sig := range testPathInfo.Sigs {
+				c.writeString(sig)
+			}
+			c.writeString(testPathInfo.CA)
+		default:
+			return
+		}
+		c.flush()
+	}
+}
+
+// testDaemonClient returns a client talking to a fakeDaemon over a pipe and
+// counts its connections.
+func testDaemonClient(failPath string) (*DaemonClient, *atomic.Int32) {
+	dials := &atomic.Int32{}
+	return &DaemonClient{dial: func() (net.Conn, error) {
+		dials.Add(1)
+		client, server := net.Pipe()
+		go fakeDaemon(server, failPath)
+		return client, nil
+	}}, dials
+}
+
+func TestDaemonQueryPathFromHashPart(t *testing.T) {
+	d, dials := testDaemonClient("")
+	storePath, err := d.QueryPathFromHashPart("p4pclmv1gyja5kzc26npqpia1qqxrf0l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storePath != testStorePath {
+		t.Errorf("got %q, want %q", storePath, testStorePath)
+	}
+	storePath, err = d.QueryPathFromHashPart("0d71ygfwbmy1xjlbj1v027dfmy9cqavy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storePath != "" {
+		t.Errorf("got %q for an unknown path", storePath)
+	}
+	if dials.Load() != 1 {
+		t.Errorf("connected %d times, the connection wasn't reused", dials.Load())
+	}
+}
+
+func TestDaemonQueryPathInfo(t *testing.T) {
+	d, _ := testDaemonClient("")
+	info, err := d.QueryPathInfo(testStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Path != testPathInfo.Path || info.Deriver != testPathInfo.Deriver || info.NarHash != testPathInfo.NarHash ||
+		info.NarSize != testPathInfo.NarSize || !slices.Equal(info.References, testPathInfo.References) || !slices.Equal(info.Sigs, testPathInfo.Sigs) {
+		t.Errorf("got %+v, want %+v", info, testPathInfo)
+	}
+
+	info, err = d.QueryPathInfo("/nix/store/0d71ygfwbmy1xjlbj1v027dfmy9cqavy-libffi-3.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != nil {
+		t.Errorf("got %+v for an invalid path", info)
+	}
+}
+
+func TestDaemonError(t *testing.T) {
+	failPath := "/nix/store/0d71ygfwbmy1xjlbj1v027dfmy9cqavy-libffi-3.3"
+	d, _ := testDaemonClient(failPath)
+	_, err := d.QueryPathInfo(failPath)
+	if err == nil || !strings.Contains(err.Error(), "is broken") {
+		t.Fatalf("got %v, want the error of the daemon", err)
+	}
+	// the broken connection isn't reused
+	_, err = d.QueryPathInfo(testStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDaemonHandshake(t *testing.T) {
+	d := &DaemonClient{dial: func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			c := &daemonConn{conn: server, r: bufio.NewReader(server), w: bufio.NewWriter(server)}
+			c.readUint64()
+			c.writeUint64(daemonMagic2)
+			c.writeUint64(2<<8 | 0)
+			c.flush()
+		}()
+		return client, nil
+	}}
+	_, err := d.QueryPathFromHashPart("p4pclmv1gyja5kzc26npqpia1qqxrf0l")
+	if err == nil || !strings.Contains(err.Error(), "Unsupported protocol version 2.0") {
+		t.Fatalf("got %v, want an unsupported protocol version", err)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+var (
+	buildIDRegex   = regexp.MustCompile(`^[0-9a-f]{2,128}$`)
+	debugFileRegex = regexp.MustCompile(`^lib/debug/\.build-id/([0-9a-f]{2})/([0-9a-f]+)\.debug$`)
+)
+
+// ValidBuildID reports whether id is a hex encoded GNU build id.
+func ValidBuildID(id string) bool {
+	return buildIDRegex.MatchString(id)
+}
+
+// ParseDebugInfoRedirect checks a redirect as written by nix and returns the
+// path of the NAR relative to the store.
+func ParseDebugInfoRedirect(r api.DebugInfoRedirect) (string, error) {
+	archive := path.Join("debuginfo", r.Archive)
+	dir, file := path.Split(archive)
+	if dir != "nar/" || !strings.Contains(file, ".nar") {
+		return "", fmt.Errorf("Invalid archive %q", r.Archive)
+	}
+	if r.Member == "" || path.IsAbs(r.Member) || path.Clean(r.Member) != r.Member || strings.HasPrefix(r.Member, "../") {
+		return "", fmt.Errorf("Invalid member %q", r.Member)
+	}
+	return archive, nil
+}
+
+// narCompression returns the compression of a NAR from its file name.
+func narCompression(file string) string {
+	_, ext, found := strings.Cut(path.Base(file), ".nar.")
+	if !found {
+		return "none"
+	}
+	return ext
+}
+
+// OpenNarMember returns the contents of a regular file in a stored NAR
+// together with its size. archive is relative to the store.
+func OpenNarMember(storePath string, archive string, member string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(storePath + "/" + archive)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := decompressNar(file, narCompression(archive))
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	nr := NewNarReader(r)
+	for {
+		header, err := nr.Next()
+		if err != nil {
+			r.Close()
+			file.Close()
+			if err == io.EOF {
+				return nil, 0, os.ErrNotExist
+			}
+			return nil, 0, err
+		}
+		if header.Path == member {
+			if header.Type != NarRegular {
+				r.Close()
+				file.Close()
+				return nil, 0, os.ErrNotExist
+			}
+			return narMember{nr, []io.Closer{r, file}}, header.Size, nil
+		}
+	}
+}
+
+type narMember struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m narMember) Close() error {
+	var errs []error
+	for _, c := range m.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// elfBuildID returns the GNU build id of an ELF file from the start of the
+// file. The note with the build id is almost always within the first
+// page, so we don't need the whole file.
+func elfBuildID(prefix []byte) (string, bool) {
+	if len(prefix) < 64 || string(prefix[:4]) != "\x7fELF" {
+		return "", false
+	}
+	var order binary.ByteOrder
+	switch prefix[5] {
+	case 1:
+		order = binary.LittleEndian
+	case 2:
+		order = binary.BigEndian
+	default:
+		return "", false
+	}
+
+	// program headers have to hold the fields read below
+	var phoff, phentsize, phnum, minPhentsize uint64
+	is64 := prefix[4] == 2
+	if is64 {
+		phoff = order.Uint64(prefix[0x20:])
+		phentsize = uint64(order.Uint16(prefix[0x36:]))
+		phnum = uint64(order.Uint16(prefix[0x38:]))
+		minPhentsize = 0x38
+	} else {
+		phoff = uint64(order.Uint32(prefix[0x1c:]))
+		phentsize = uint64(order.Uint16(prefix[0x2a:]))
+		phnum = uint64(order.Uint16(prefix[0x2c:]))
+		minPhentsize = 0x20
+	}
+	// phentsize and phnum are 16 bit, so only phoff can overflow
+	if phentsize < minPhentsize || phoff > uint64(len(prefix)) {
+		return "", false
+	}
+
+	for i := uint64(0); i < phnum; i++ {
+		start := phoff + i*phentsize
+		if start+phentsize > uint64(len(prefix)) {
+			return "", false
+		}
+		ph := prefix[start : start+phentsize]
+		// PT_NOTE
+		if order.Uint32(ph) != 4 {
+			continue
+		}
+		var offset, size uint64
+		if is64 {
+			offset = order.Uint64(ph[0x08:])
+			size = order.Uint64(ph[0x20:])
+		} else {
+			offset = uint64(order.Uint32(ph[0x04:]))
+			size = uint64(order.Uint32(ph[0x10:]))
+		}
+		if offset+size > uint64(len(prefix)) || offset+size < offset {
+			continue
+		}
+		id, ok := gnuBuildIDNote(prefix[offset:offset+size], order)
+		if ok {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func gnuBuildIDNote(notes []byte, order binary.ByteOrder) (string, bool) {
+	align := func(n uint64) uint64 { return (n + 3) &^ 3 }
+	for len(notes) >= 12 {
+		namesz := uint64(order.Uint32(notes[0:]))
+		descsz := uint64(order.Uint32(notes[4:]))
+		typ := order.Uint32(notes[8:])
+		notes = notes[12:]
+		if align(namesz)+align(descsz) > uint64(len(notes)) {
+			return "", false
+		}
+		name := notes[:namesz]
+		desc := notes[align(namesz) : align(namesz)+descsz]
+		notes = notes[align(namesz)+align(descsz):]
+		// NT_GNU_BUILD_ID
+		if typ == 3 && string(name) == "GNU\x00" && len(desc) > 0 {
+			return hex.EncodeToString(desc), true
+		}
+	}
+	return "", false
+}
+
+// IndexBuildIDs records the build ids of all ELF files in a stored NAR. Files
+// in lib/debug/.build-id are recorded as debug info, other ELF files as
+// executables.
+func IndexBuildIDs(storePath string, narFile string) error {
+	archive := "nar/" + narFile
+	file, err := os.Open(storePath + "/" + archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := decompressNar(file, narCompression(narFile))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	nr := NewNarReader(r)
+	prefix := make([]byte, 64*1024)
+	for {
+		header, err := nr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Type != NarRegular {
+			continue
+		}
+
+		redirect := api.DebugInfoRedirect{Archive: "../" + archive, Member: header.Path}
+		if m := debugFileRegex.FindStringSubmatch(header.Path); m != nil {
+			err = writeDebugInfoRedirect(storePath+"/debuginfo", m[1]+m[2], redirect)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		n, err := io.ReadFull(nr, prefix)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		id, ok := elfBuildID(prefix[:n])
+		if !ok {
+			continue
+		}
+		err = writeDebugInfoRedirect(storePath+"/executable", id, redirect)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeDebugInfoRedirect(dir string, id string, redirect api.DebugInfoRedirect) error {
+	data, err := json.Marshal(redirect)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dir+"/"+id, data, 0660)
+}
+
+// ReadDebugInfoRedirect reads a stored redirect from dir, which is either
+// the debuginfo or the executable index.
+func ReadDebugInfoRedirect(dir string, id string) (api.DebugInfoRedirect, error) {
+	var redirect api.DebugInfoRedirect
+	data, err := os.ReadFile(dir + "/" + id)
+	if err != nil {
+		return redirect, err
+	}
+	err = json.Unmarshal(data, &redirect)
+	return redirect, err
+}
+
+// DebuginfodHandler serves the debuginfod protocol from the NARs in the
+// store.
+func (n NixStored) DebuginfodHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /buildid/{buildid}/debuginfo", func(w http.ResponseWriter, r *http.Request) {
+		n.serveBuildID(w, r, "debuginfo")
+	})
+	mux.HandleFunc("GET /buildid/{buildid}/executable", func(w http.ResponseWriter, r *http.Request) {
+		n.serveBuildID(w, r, "executable")
+	})
+	mux.HandleFunc("GET /buildid/{buildid}/source/{path...}", n.serveSource)
+	return mux
+}
+
+func (n NixStored) serveBuildID(w http.ResponseWriter, r *http.Request, index string) {
+	id := r.PathValue("buildid")
+	if !ValidBuildID(id) {
+		http.NotFound(w, r)
+		return
+	}
+	redirect, err := ReadDebugInfoRedirect(n.StorePath+"/"+index, id)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Couldn't read debuginfo redirect", "index", index, "buildid", id, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	archive, err := ParseDebugInfoRedirect(redirect)
+	if err != nil {
+		slog.Error("Stored debuginfo redirect is invalid", "index", index, "buildid", id, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	n.serveNarMember(w, r, archive, redirect.Member)
+}
+
+func (n NixStored) serveSource(w http.ResponseWriter, r *http.Request) {
+	if !ValidBuildID(r.PathValue("buildid")) {
+		http.NotFound(w, r)
+		return
+	}
+	// only sources in the nix store can be served, everything else was only
+	// available in the build sandbox
+	storePath, member, _ := strings.Cut(strings.TrimPrefix("/"+r.PathValue("path"), n.CacheInfo.StoreDir+"/"), "/")
+	if len(storePath) < 32 || member == "" || !storePathBaseRegex.MatchString(storePath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	filename := fmt.Sprintf("%s/%s.narinfo", n.StorePath, storePath[:32])
+	file, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Couldn't open file", "file", filename, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	info, err := ParseNarInfo(file)
+	file.Close()
+	if err != nil {
+		slog.Error("Couldn't parse narinfo", "storepath", storePath, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	n.serveNarMember(w, r, path.Clean(info.URL), path.Clean(member))
+}
+
+func (n NixStored) serveNarMember(w http.ResponseWriter, r *http.Request, archive string, member string) {
+	if !strings.HasPrefix(archive, "nar/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := n.limit.Acquire(r.Context(), 1)
+	if err != nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer n.limit.Release(1)
+
+	body, size, err := OpenNarMember(n.StorePath, archive, member)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Couldn't read NAR member", "archive", archive, "member", member, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(size))
+	w.Header().Set("X-Debuginfod-Size", fmt.Sprint(size))
+	_, err = io.Copy(w, body)
+	if err != nil {
+		slog.Warn("Couldn't send NAR member", "archive", archive, "member", member, "error", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// testELF returns a 64 bit little endian ELF header with a single PT_NOTE
+// program header pointing at a GNU build id note.
+func testELF(phoff uint64, phentsize uint16, phnum uint16) []byte {
+	elf := make([]byte, 0x100)
+	copy(elf, "\x7fELF\x02\x01\x01")
+	le := binary.LittleEndian
+	le.PutUint64(elf[0x20:], phoff)
+	le.PutUint16(elf[0x36:], phentsize)
+	le.PutUint16(elf[0x38:], phnum)
+
+	ph := elf[0x40:]
+	le.PutUint32(ph[0x00:], 4)
+	le.PutUint64(ph[0x08:], 0xc0)
+	le.PutUint64(ph[0x20:], 20)
+
+	note := elf[0xc0:]
+	le.PutUint32(note[0:], 4)
+	le.PutUint32(note[4:], 4)
+	le.PutUint32(note[8:], 3)
+	copy(note[12:], "GNU\x00\xde\xad\xbe\xef")
+	return elf
+}
+
+func TestElfBuildID(t *testing.T) {
+	id, ok := elfBuildID(testELF(0x40, 0x38, 1))
+	if !ok || id != "deadbeef" {
+		t.Fatalf("got %q, %v, want deadbeef", id, ok)
+	}
+}
+
+func TestElfBuildIDCrafted(t *testing.T) {
+	tests := map[string][]byte{
+		"short phentsize":     testELF(0x40, 0x20, 1),
+		"barely short":        testELF(0x40, 0x27, 1),
+		"phoff overflows":     testELF(^uint64(0)-0x37, 0x38, 2),
+		"phoff past the end":  testELF(0x1000, 0x38, 1),
+		"many headers":        testELF(0x40, 0xffff, 0xffff),
+		"truncated":           testELF(0x40, 0x38, 1)[:0x50],
+		"32 bit short header": append([]byte("\x7fELF\x01\x01\x01"), make([]byte, 0x80)...),
+	}
+	// only the 32 bit case needs its header fields set
+	elf32 := tests["32 bit short header"]
+	binary.LittleEndian.PutUint32(elf32[0x1c:], 0x34)
+	binary.LittleEndian.PutUint16(elf32[0x2a:], 0x1f)
+	binary.LittleEndian.PutUint16(elf32[0x2c:], 1)
+
+	for name, elf := range tests {
+		t.Run(name, func(t *testing.T) {
+			id, ok := elfBuildID(elf)
+			if ok {
+				t.Errorf("found build id %q", id)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decodeContentEncoding wraps r so that it yields the body without the given
+// Content-Encoding. Nix uses this to compress listings and logs on upload.
+func decodeContentEncoding(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "", "identity":
+		return io.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("Unsupported content encoding: %s", encoding)
+	}
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows the given
+// content coding. A missing header only allows identity, since clients like
+// curl don't decode anything they didn't ask for.
+func acceptsEncoding(header *string, encoding string) bool {
+	if header == nil {
+		return false
+	}
+	accepted := false
+	for _, part := range strings.Split(*header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != encoding && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) == "q" {
+				q, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+			}
+		}
+		// an explicit entry always wins over the wildcard
+		if name == encoding {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
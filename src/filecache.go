@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// cacheDir is a binary cache in a directory, either the store of a cache or
+// a file:// binary cache as written by nix copy. Both have the same layout,
+// except for logs, which nix stores uncompressed without extension.
+type cacheDir struct {
+	path      string
+	plainLogs bool
+}
+
+// ParseFileCache parses the path or file:// url of a binary cache directory.
+func ParseFileCache(s string) (string, error) {
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", err
+		}
+		if u.Scheme != "file" || (u.Host != "" && u.Host != "localhost") {
+			return "", fmt.Errorf("Unsupported binary cache %q, only file:// urls and paths are supported", s)
+		}
+		s = u.Path
+	}
+	if s == "" {
+		return "", fmt.Errorf("Empty binary cache path")
+	}
+	return filepath.Abs(s)
+}
+
+// readStoreDir returns the StoreDir of the nix-cache-info of a binary cache
+// directory.
+func readStoreDir(dir string) (string, error) {
+	file, err := os.Open(dir + "/nix-cache-info")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%s is no binary cache, it has no nix-cache-info", dir)
+		}
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "StoreDir:")
+		if ok {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	if scanner.Err() != nil {
+		return "", scanner.Err()
+	}
+	// nix assumes the default store dir as well
+	return "/nix/store", nil
+}
+
+// ImportFileCache copies the paths of the file:// binary cache at dir that
+// the cache at storePath doesn't have into the cache. opts select the paths
+// like for Sync, Remote, Push and Pull are ignored. NARs are checked against
+// their narinfo before anything is stored. copied is called for every copied
+// or failed path and narStored for every stored NAR.
+func ImportFileCache(ctx context.Context, storePath string, storeDir string, dir string, opts SyncOptions, copied func(storePath string, err error), narStored func(narFile string)) error {
+	sourceStoreDir, err := readStoreDir(dir)
+	if err != nil {
+		return err
+	}
+	if sourceStoreDir != storeDir {
+		return fmt.Errorf("%s is a binary cache for %s, not %s", dir, sourceStoreDir, storeDir)
+	}
+	return copyCacheDir(ctx, cacheDir{path: dir, plainLogs: true}, cacheDir{path: storePath}, opts, copied, narStored)
+}
+
+// ExportFileCache copies the paths of the cache at storePath to the file://
+// binary cache at dir, which is created if it doesn't exist. opts select the
+// paths like for Sync, Remote, Push and Pull are ignored. A dry run doesn't
+// create anything.
+func ExportFileCache(ctx context.Context, storePath string, storeDir string, dir string, opts SyncOptions, copied func(storePath string, err error)) error {
+	_, err := os.Stat(dir + "/nix-cache-info")
+	if errors.Is(err, os.ErrNotExist) && !opts.DryRun {
+		for _, sub := range []string{"", "/nar", "/log"} {
+			err = os.MkdirAll(dir+sub, 0775)
+			if err != nil {
+				return err
+			}
+		}
+		err = StoreUpload(dir+"/nix-cache-info", strings.NewReader(fmt.Sprintf("StoreDir: %s\n", storeDir)))
+	}
+	if err != nil && !(errors.Is(err, os.ErrNotExist) && opts.DryRun) {
+		return err
+	}
+	targetStoreDir, err := readStoreDir(dir)
+	if err != nil && !opts.DryRun {
+		return err
+	}
+	if err == nil && targetStoreDir != storeDir {
+		return fmt.Errorf("%s is a binary cache for %s, not %s", dir, targetStoreDir, storeDir)
+	}
+	return copyCacheDir(ctx, cacheDir{path: storePath}, cacheDir{path: dir, plainLogs: true}, opts, copied, nil)
+}
+
+// copyCacheDir copies the selected paths src has and dst doesn't, with their
+// closures, references first.
+func copyCacheDir(ctx context.Context, src cacheDir, dst cacheDir, opts SyncOptions, copied func(storePath string, err error), narStored func(narFile string)) error {
+	opts.Pull = true
+	err := opts.Validate()
+	if err != nil {
+		return err
+	}
+	candidates := make([]string, len(opts.Roots))
+	for i, root := range opts.Roots {
+		candidates[i], _, _ = strings.Cut(path.Base(root), "-")
+	}
+	if len(candidates) == 0 {
+		candidates, err = listNarInfos(src.path)
+		if err != nil {
+			return err
+		}
+	}
+
+	s := &syncer{opts: opts, local: src.path, copied: copied}
+	has := func(hash string) (bool, error) {
+		_, err := os.Stat(fmt.Sprintf("%s/%s.narinfo", dst.path, hash))
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	paths, broken, err := s.plan(ctx, candidates, s.lookupLocal, has)
+	if err != nil {
+		return err
+	}
+	var done, failed []string
+	s.copyPaths(ctx, paths, broken, &done, &failed, func(p syncPath) error {
+		return copyCachePath(src, dst, p, narStored)
+	})
+	return ctx.Err()
+}
+
+// copyCachePath copies the NAR, listing and log of a path. The narinfo comes
+// last, so the path only shows up when it's complete.
+func copyCachePath(src cacheDir, dst cacheDir, p syncPath, narStored func(narFile string)) error {
+	dir, narFile := path.Split(path.Clean(p.info.URL))
+	if _, ok := parseNarFile(narFile); !ok || dir != "nar/" {
+		return fmt.Errorf("Unsupported NAR url %q", p.info.URL)
+	}
+	_, err := os.Stat(dst.path + "/nar/" + narFile)
+	if errors.Is(err, os.ErrNotExist) {
+		err = copyNar(src.path+"/nar/"+narFile, dst.path+"/nar/"+narFile, p.info)
+		if err == nil && narStored != nil {
+			narStored(narFile)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	listing, err := os.ReadFile(fmt.Sprintf("%s/%s.ls", src.path, p.hash))
+	if err == nil {
+		_, err = ParseFileListing(listing)
+		if err != nil {
+			return fmt.Errorf("Invalid listing of %s: %w", p.info.StorePath, err)
+		}
+		err = StoreUpload(fmt.Sprintf("%s/%s.ls", dst.path, p.hash), strings.NewReader(string(listing)))
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if ValidDeriver(p.info.Deriver) {
+		err = copyLog(src, dst, p.info.Deriver)
+		if err != nil {
+			return fmt.Errorf("Couldn't copy log of %s: %w", p.info.Deriver, err)
+		}
+	}
+
+	info := *p.info
+	info.URL = "nar/" + narFile
+	return StoreNarInfo(fmt.Sprintf("%s/%s.narinfo", dst.path, p.hash), []byte(info.String()))
+}
+
+// copyNar copies a NAR, checking it against the FileHash and NarHash of
+// info.
+func copyNar(srcFile string, dstFile string, info *NarInfo) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dstFile), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = checkNar(io.TeeReader(src, tmp), info)
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0660)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dstFile)
+}
+
+// copyLog copies the log of a deriver if src has it and dst doesn't.
+func copyLog(src cacheDir, dst cacheDir, deriver string) error {
+	if dst.plainLogs {
+		_, err := os.Stat(dst.path + "/log/" + deriver)
+		if err == nil {
+			return nil
+		}
+	} else {
+		file, _, err := OpenBuildLog(dst.path+"/log", deriver)
+		if err == nil {
+			file.Close()
+			return nil
+		}
+	}
+
+	var log io.ReadCloser
+	if src.plainLogs {
+		file, err := os.Open(src.path + "/log/" + deriver)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		log = file
+	} else {
+		file, encoding, err := OpenBuildLog(src.path+"/log", deriver)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		defer file.Close()
+		log, err = decodeContentEncoding(file, encoding)
+		if err != nil {
+			return err
+		}
+	}
+	defer log.Close()
+
+	if dst.plainLogs {
+		return StoreUpload(dst.path+"/log/"+deriver, log)
+	}
+	return StoreBuildLog(dst.path+"/log", deriver, log, "")
+}
+
+// checkNar reads a NAR and checks it against the FileHash and NarHash of
+// info.
+func checkNar(r io.Reader, info *NarInfo) error {
+	compressed := &countingWriter{hash: sha256.New()}
+	tee := io.TeeReader(r, compressed)
+	nar, err := decompressNar(tee, info.Compression)
+	if err != nil {
+		return err
+	}
+	uncompressed := &countingWriter{hash: sha256.New()}
+	_, err = io.Copy(uncompressed, nar)
+	nar.Close()
+	if err != nil {
+		return fmt.Errorf("Couldn't decompress NAR of %s: %w", info.StorePath, err)
+	}
+	// decompressors may stop before the end of the file
+	_, err = io.Copy(io.Discard, tee)
+	if err != nil {
+		return err
+	}
+
+	if info.FileHash != "" && (!hashMatches(info.FileHash, compressed.hash.Sum(nil)) || compressed.size != info.FileSize) {
+		return fmt.Errorf("NAR doesn't match the FileHash of %s", info.StorePath)
+	}
+	if !hashMatches(info.NarHash, uncompressed.hash.Sum(nil)) || uncompressed.size != info.NarSize {
+		return fmt.Errorf("NAR doesn't match the NarHash of %s", info.StorePath)
+	}
+	return nil
+}
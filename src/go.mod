@@ -5,12 +5,19 @@ go 1.23.0
 toolchain go1.24.3
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/go-chi/chi/v5 v5.2.1
+	github.com/klauspost/compress v1.18.0
 	github.com/oapi-codegen/runtime v1.1.1
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/crypto v0.36.0
+	golang.org/x/net v0.38.0
 	golang.org/x/sync v0.15.0
 )
 
 require (
 	github.com/apapsch/go-jsonmerge/v2 v2.0.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
 )
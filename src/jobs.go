@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how long finished jobs can be looked up
+const jobRetention = time.Hour
+
+// workers runs the background work of a cache, like replication, and the
+// jobs. ctx stops them, wg tells when all of them stopped.
+type workers struct {
+	ctx context.Context
+	wg  sync.WaitGroup
+}
+
+func newWorkers(ctx context.Context) *workers {
+	return &workers{ctx: ctx}
+}
+
+// Go runs f in the background.
+func (w *workers) Go(f func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		f(w.ctx)
+	}()
+}
+
+// Wait waits until all workers returned.
+func (w *workers) Wait() {
+	w.wg.Wait()
+}
+
+// job is a prefetch or sync running in the background. finishedAt is zero
+// while it runs.
+type job interface {
+	finishedAt() time.Time
+}
+
+// jobList are the jobs of one kind of a cache, by id.
+type jobList[J job] struct {
+	mu   sync.Mutex
+	jobs map[string]J
+}
+
+func newJobList[J job]() *jobList[J] {
+	return &jobList[J]{jobs: map[string]J{}}
+}
+
+func newJobID() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (l *jobList[J]) add(id string, j J) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// forget old jobs
+	for id, old := range l.jobs {
+		finished := old.finishedAt()
+		if !finished.IsZero() && time.Since(finished) > jobRetention {
+			delete(l.jobs, id)
+		}
+	}
+	l.jobs[id] = j
+}
+
+func (l *jobList[J]) get(id string) (J, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	j, ok := l.jobs[id]
+	if !ok {
+		return j, fmt.Errorf("Unknown job %q", id)
+	}
+	return j, nil
+}
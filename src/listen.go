@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Listen opens the listeners for the comma separated addresses. Addresses
+// are host:port or unix:/path/to/socket. Sockets passed by systemd socket
+// activation replace the configured addresses.
+func Listen(addresses string) ([]net.Listener, error) {
+	listeners, err := sdListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+
+	for _, address := range strings.Split(addresses, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		l, err := listen(address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("No address to listen on")
+	}
+	return listeners, nil
+}
+
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	// remove the socket of a previous run, but nothing else
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode().Type() == os.ModeSocket {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// the permissions of the socket follow the umask
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+// listingEntry is the union of all fields a FileListing entry can have.
+// The generated union types don't validate their content, so we use this
+// to walk the tree.
+type listingEntry struct {
+	Type      api.FileListingEntryType   `json:"type"`
+	Entries   map[string]json.RawMessage `json:"entries"`
+	Size      *int64                     `json:"size"`
+	NarOffset *int64                     `json:"narOffset"`
+	Target    *string                    `json:"target"`
+}
+
+// ParseFileListing parses and validates a NAR listing as written by nix
+// with write-nar-listing=1.
+func ParseFileListing(data []byte) (api.FileListing, error) {
+	var listing api.FileListing
+	err := json.Unmarshal(data, &listing)
+	if err != nil {
+		return api.FileListing{}, fmt.Errorf("Couldn't parse listing: %w", err)
+	}
+	if listing.Version == nil || *listing.Version != 1 {
+		return api.FileListing{}, fmt.Errorf("Unsupported listing version")
+	}
+	if listing.Root == nil {
+		return api.FileListing{}, fmt.Errorf("Listing has no root")
+	}
+	root, err := listing.Root.MarshalJSON()
+	if err != nil {
+		return api.FileListing{}, err
+	}
+	err = validateListingEntry(root, "/")
+	if err != nil {
+		return api.FileListing{}, err
+	}
+	return listing, nil
+}
+
+func validateListingEntry(data []byte, where string) error {
+	var entry listingEntry
+	err := json.Unmarshal(data, &entry)
+	if err != nil {
+		return fmt.Errorf("Invalid entry %s: %w", where, err)
+	}
+
+	switch entry.Type {
+	case api.Directory:
+		if entry.Entries == nil {
+			return fmt.Errorf("Directory %s has no entries", where)
+		}
+		for name, child := range entry.Entries {
+			if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+				return fmt.Errorf("Invalid name %q in %s", name, where)
+			}
+			err = validateListingEntry(child, path.Join(where, name))
+			if err != nil {
+				return err
+			}
+		}
+	case api.Regular:
+		if entry.Size == nil || *entry.Size < 0 {
+			return fmt.Errorf("File %s has no valid size", where)
+		}
+		if entry.NarOffset != nil && *entry.NarOffset < 0 {
+			return fmt.Errorf("File %s has an invalid narOffset", where)
+		}
+	case api.Symlink:
+		if entry.Target == nil {
+			return fmt.Errorf("Symlink %s has no target", where)
+		}
+	default:
+		return fmt.Errorf("Entry %s has unknown type %q", where, entry.Type)
+	}
+	return nil
+}
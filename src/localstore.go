@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// LocalStore serves the paths of the nix store of the host, like nix-serve
+// does. Path metadata comes from the nix daemon, NARs are generated from the
+// file system on the fly.
+type LocalStore struct {
+	daemon      *DaemonClient
+	key         *SecretKey
+	compression Recompression
+}
+
+func NewLocalStore(socket string, key *SecretKey, compression Recompression) *LocalStore {
+	return &LocalStore{daemon: NewDaemonClient(socket), key: key, compression: compression}
+}
+
+// pathInfo returns the store path and metadata of a path with the nar hash
+// in nix base32, or nil if the store doesn't have it.
+func (l *LocalStore) pathInfo(storePathHash string) (*PathInfo, string, error) {
+	if !storePathHashRegex.MatchString(storePathHash) {
+		return nil, "", nil
+	}
+	storePath, err := l.daemon.QueryPathFromHashPart(storePathHash)
+	if err != nil || storePath == "" {
+		return nil, "", err
+	}
+	info, err := l.daemon.QueryPathInfo(storePath)
+	if err != nil || info == nil {
+		return nil, "", err
+	}
+	// the daemon sends base16 hashes, with or without the algorithm
+	narHash := strings.TrimPrefix(info.NarHash, "sha256:")
+	if len(narHash) == 64 {
+		sum, err := hex.DecodeString(narHash)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid nar hash of %s: %w", storePath, err)
+		}
+		narHash = nixBase32(sum)
+	}
+	if len(narHash) != 52 {
+		return nil, "", fmt.Errorf("Unsupported nar hash %q of %s", info.NarHash, storePath)
+	}
+	return info, narHash, nil
+}
+
+// NarInfo returns the narinfo of a path, or nil if the store doesn't have
+// it. The path is signed if there is a key. The NAR is named after the
+// store path hash and the nar hash, so it can be found without any state.
+func (l *LocalStore) NarInfo(storePathHash string) (*NarInfo, error) {
+	info, narHash, err := l.pathInfo(storePathHash)
+	if err != nil || info == nil {
+		return nil, err
+	}
+
+	narInfo := &NarInfo{
+		StorePath:   info.Path,
+		URL:         "nar/" + l.compression.narFileName(storePathHash+narHash),
+		Compression: l.compression.Compression,
+		NarHash:     "sha256:" + narHash,
+		NarSize:     info.NarSize,
+		Sigs:        info.Sigs,
+		CA:          info.CA,
+	}
+	for _, ref := range info.References {
+		narInfo.References = append(narInfo.References, path.Base(ref))
+	}
+	if info.Deriver != "" {
+		narInfo.Deriver = path.Base(info.Deriver)
+	}
+	if l.key != nil {
+		narInfo.Sigs = append(narInfo.Sigs, l.key.Sign(narInfo.Fingerprint()))
+	}
+	return narInfo, nil
+}
+
+// OpenNar generates the NAR of a narinfo returned by NarInfo. size is -1 if
+// the NAR is compressed. It returns os.ErrNotExist if the path is gone or
+// changed.
+func (l *LocalStore) OpenNar(narFile string) (io.ReadCloser, int64, error) {
+	fileHash, _, _ := strings.Cut(narFile, ".")
+	if len(fileHash) != 32+52 || l.compression.narFileName(fileHash) != narFile {
+		return nil, 0, os.ErrNotExist
+	}
+	info, narHash, err := l.pathInfo(fileHash[:32])
+	if err != nil {
+		return nil, 0, err
+	}
+	if info == nil || narHash != fileHash[32:] {
+		return nil, 0, os.ErrNotExist
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := l.compression.newWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		// the NAR is broken off if the files don't match the nar hash
+		// anymore, nix checks the hash as well
+		uncompressed := &countingWriter{hash: sha256.New()}
+		err = WriteNar(io.MultiWriter(w, uncompressed), info.Path)
+		if err == nil && (nixBase32(uncompressed.hash.Sum(nil)) != narHash || uncompressed.size != info.NarSize) {
+			err = fmt.Errorf("%s doesn't match its nar hash", info.Path)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	size := int64(-1)
+	if l.compression.Compression == "none" {
+		size = int64(info.NarSize)
+	}
+	return pr, size, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type replicationMetric struct {
+	name  string
+	help  string
+	typ   string
+	value func(r *Replicator) float64
+}
+
+var replicationMetrics = []replicationMetric{
+	{"nix_stored_replication_queue_length", "Paths waiting to be replicated.", "gauge", func(r *Replicator) float64 {
+		length, _ := r.Lag()
+		return float64(length)
+	}},
+	{"nix_stored_replication_lag_seconds", "Age of the oldest path waiting to be replicated.", "gauge", func(r *Replicator) float64 {
+		_, lag := r.Lag()
+		return lag.Seconds()
+	}},
+	{"nix_stored_replication_pushed_total", "Paths replicated since the start.", "counter", func(r *Replicator) float64 {
+		return float64(r.Pushed.Load())
+	}},
+	{"nix_stored_replication_errors_total", "Failed replication attempts since the start.", "counter", func(r *Replicator) float64 {
+		return float64(r.Errors.Load())
+	}},
+	{"nix_stored_replication_failed_total", "Paths given up on since the start.", "counter", func(r *Replicator) float64 {
+		return float64(r.Failed.Load())
+	}},
+	{"nix_stored_replication_last_success_timestamp_seconds", "Time of the last successful replication.", "gauge", func(r *Replicator) float64 {
+		return float64(r.LastSuccess.Load())
+	}},
+}
+
+// MetricsHandler serves metrics of all caches in the prometheus text
+// format.
+func MetricsHandler(caches []*Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, metric := range replicationMetrics {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.typ)
+			for _, cache := range caches {
+				for _, replicator := range cache.Replicators {
+					fmt.Fprintf(w, "%s{cache=%q,target=%q} %g\n", metric.name, cache.Settings.Name, replicator.String(), metric.value(replicator))
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// NarType is the type of a node in a NAR.
+type NarType string
+
+const (
+	NarDirectory NarType = "directory"
+	NarRegular   NarType = "regular"
+	NarSymlink   NarType = "symlink"
+)
+
+// NarHeader describes a node of a NAR. Path is relative to the root of the
+// NAR, the root itself has an empty path.
+type NarHeader struct {
+	Path       string
+	Type       NarType
+	Executable bool
+	Size       int64
+	LinkTarget string
+}
+
+const narMagic = "nix-archive-1"
+
+// maximum length of strings in a NAR that aren't file contents
+const narMaxString = 4096
+
+// NarReader reads the nodes of a NAR one after another, like tar.Reader
+// does for tar archives. Directories are returned before their entries.
+type NarReader struct {
+	r         io.Reader
+	dirs      []string
+	remaining int64
+	padding   int64
+	inFile    bool
+	started   bool
+	done      bool
+}
+
+func NewNarReader(r io.Reader) *NarReader {
+	return &NarReader{r: r}
+}
+
+// Next advances to the next node of the NAR. It returns io.EOF at the end of
+// the archive.
+func (nr *NarReader) Next() (*NarHeader, error) {
+	if !nr.started {
+		nr.started = true
+		err := nr.expect(narMagic)
+		if err != nil {
+			return nil, err
+		}
+		return nr.readNode("")
+	}
+
+	if nr.inFile {
+		_, err := io.CopyN(io.Discard, nr.r, nr.remaining+nr.padding)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		nr.inFile = false
+		err = nr.expect(")")
+		if err != nil {
+			return nil, err
+		}
+		err = nr.closeEntry()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for !nr.done {
+		token, err := nr.readString(narMaxString)
+		if err != nil {
+			return nil, err
+		}
+		switch token {
+		case ")":
+			nr.dirs = nr.dirs[:len(nr.dirs)-1]
+			err = nr.closeEntry()
+			if err != nil {
+				return nil, err
+			}
+		case "entry":
+			for _, s := range []string{"(", "name"} {
+				err = nr.expect(s)
+				if err != nil {
+					return nil, err
+				}
+			}
+			name, err := nr.readString(narMaxString)
+			if err != nil {
+				return nil, err
+			}
+			if name == "" || name == "." || name == ".." || path.Base(name) != name {
+				return nil, fmt.Errorf("Invalid NAR entry name %q", name)
+			}
+			err = nr.expect("node")
+			if err != nil {
+				return nil, err
+			}
+			return nr.readNode(path.Join(nr.dirs[len(nr.dirs)-1], name))
+		default:
+			return nil, fmt.Errorf("Unexpected NAR token %q", token)
+		}
+	}
+	return nil, io.EOF
+}
+
+// Read reads the contents of the current regular file.
+func (nr *NarReader) Read(p []byte) (int, error) {
+	if !nr.inFile || nr.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > nr.remaining {
+		p = p[:nr.remaining]
+	}
+	n, err := nr.r.Read(p)
+	nr.remaining -= int64(n)
+	if err == io.EOF && nr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (nr *NarReader) readNode(p string) (*NarHeader, error) {
+	for _, s := range []string{"(", "type"} {
+		err := nr.expect(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t, err := nr.readString(narMaxString)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &NarHeader{Path: p, Type: NarType(t)}
+	switch header.Type {
+	case NarRegular:
+		token, err := nr.readString(narMaxString)
+		if err != nil {
+			return nil, err
+		}
+		if token == "executable" {
+			header.Executable = true
+			err = nr.expect("")
+			if err != nil {
+				return nil, err
+			}
+			token, err = nr.readString(narMaxString)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if token != "contents" {
+			return nil, fmt.Errorf("Unexpected NAR token %q", token)
+		}
+		size, err := nr.readUint64()
+		if err != nil {
+			return nil, err
+		}
+		if size > math.MaxInt64 {
+			return nil, fmt.Errorf("Invalid NAR file size %d", size)
+		}
+		header.Size = int64(size)
+		nr.remaining = header.Size
+		nr.padding = padding(size)
+		nr.inFile = true
+	case NarSymlink:
+		err = nr.expect("target")
+		if err != nil {
+			return nil, err
+		}
+		header.LinkTarget, err = nr.readString(narMaxString)
+		if err != nil {
+			return nil, err
+		}
+		err = nr.expect(")")
+		if err != nil {
+			return nil, err
+		}
+		err = nr.closeEntry()
+		if err != nil {
+			return nil, err
+		}
+	case NarDirectory:
+		nr.dirs = append(nr.dirs, p)
+	default:
+		return nil, fmt.Errorf("Unknown NAR node type %q", t)
+	}
+	return header, nil
+}
+
+// closeEntry is called after a node is complete. It consumes the end of the
+// directory entry the node belongs to.
+func (nr *NarReader) closeEntry() error {
+	if len(nr.dirs) == 0 {
+		nr.done = true
+		return nil
+	}
+	return nr.expect(")")
+}
+
+func (nr *NarReader) expect(s string) error {
+	token, err := nr.readString(narMaxString)
+	if err != nil {
+		return err
+	}
+	if token != s {
+		return fmt.Errorf("Expected NAR token %q, got %q", s, token)
+	}
+	return nil
+}
+
+func (nr *NarReader) readUint64() (uint64, error) {
+	var buf [8]byte
+	_, err := io.ReadFull(nr.r, buf[:])
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+func (nr *NarReader) readString(max uint64) (string, error) {
+	size, err := nr.readUint64()
+	if err != nil {
+		return "", err
+	}
+	if size > max {
+		return "", fmt.Errorf("NAR string too long")
+	}
+	buf := make([]byte, int64(size)+padding(size))
+	_, err = io.ReadFull(nr.r, buf)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return string(buf[:size]), nil
+}
+
+func padding(size uint64) int64 {
+	return int64((8 - size%8) % 8)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WriteNar writes the file, directory or symlink at p as NAR, like
+// nix-store --dump does.
+func WriteNar(w io.Writer, p string) error {
+	nw := &narWriter{w: bufio.NewWriterSize(w, 64*1024)}
+	nw.writeString(narMagic)
+	err := nw.writeNode(p)
+	if err != nil {
+		return err
+	}
+	if nw.err != nil {
+		return nw.err
+	}
+	return nw.w.Flush()
+}
+
+// narWriter remembers the first write error, so the structure of the NAR
+// isn't hidden between error checks.
+type narWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (nw *narWriter) write(p []byte) {
+	if nw.err == nil {
+		_, nw.err = nw.w.Write(p)
+	}
+}
+
+func (nw *narWriter) writeUint64(n uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], n)
+	nw.write(buf[:])
+}
+
+func (nw *narWriter) writePadding(size uint64) {
+	var zeros [8]byte
+	nw.write(zeros[:padding(size)])
+}
+
+func (nw *narWriter) writeString(s string) {
+	nw.writeUint64(uint64(len(s)))
+	nw.write([]byte(s))
+	nw.writePadding(uint64(len(s)))
+}
+
+func (nw *narWriter) writeNode(p string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	nw.writeString("(")
+	nw.writeString("type")
+	switch {
+	case info.Mode().IsRegular():
+		nw.writeString(string(NarRegular))
+		if info.Mode()&0100 != 0 {
+			nw.writeString("executable")
+			nw.writeString("")
+		}
+		err = nw.writeContents(p, info.Size())
+		if err != nil {
+			return err
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		nw.writeString(string(NarSymlink))
+		nw.writeString("target")
+		nw.writeString(target)
+	case info.IsDir():
+		nw.writeString(string(NarDirectory))
+		// os.ReadDir sorts by name like nix does
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			nw.writeString("entry")
+			nw.writeString("(")
+			nw.writeString("name")
+			nw.writeString(entry.Name())
+			nw.writeString("node")
+			err = nw.writeNode(filepath.Join(p, entry.Name()))
+			if err != nil {
+				return err
+			}
+			nw.writeString(")")
+		}
+	default:
+		return fmt.Errorf("Unsupported file type of %s", p)
+	}
+	nw.writeString(")")
+	return nw.err
+}
+
+func (nw *narWriter) writeContents(p string, size int64) error {
+	nw.writeString("contents")
+	nw.writeUint64(uint64(size))
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if nw.err != nil {
+		return nw.err
+	}
+	n, err := io.Copy(nw.w, io.LimitReader(file, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%s changed while it was archived", p)
+	}
+	nw.writePadding(uint64(size))
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// testNar encodes NAR strings, sizes and file contents.
+func testNar(tokens ...any) []byte {
+	var buf bytes.Buffer
+	for _, token := range tokens {
+		switch t := token.(type) {
+		case string:
+			binary.Write(&buf, binary.LittleEndian, uint64(len(t)))
+			buf.WriteString(t)
+			buf.Write(make([]byte, padding(uint64(len(t)))))
+		case uint64:
+			binary.Write(&buf, binary.LittleEndian, t)
+		case []byte:
+			buf.Write(t)
+			buf.Write(make([]byte, padding(uint64(len(t)))))
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestNarReader(t *testing.T) {
+	nar := testNar(narMagic, "(", "type", "regular", "executable", "", "contents", uint64(5), []byte("hello"), ")")
+	nr := NewNarReader(bytes.NewReader(nar))
+	header, err := nr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Type != NarRegular || !header.Executable || header.Size != 5 {
+		t.Errorf("got %+v", header)
+	}
+	data, err := io.ReadAll(nr)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	_, err = nr.Next()
+	if err != io.EOF {
+		t.Errorf("got %v at the end", err)
+	}
+}
+
+func TestNarReaderHugeSize(t *testing.T) {
+	nar := testNar(narMagic, "(", "type", "regular", "contents", uint64(1<<63), []byte("hello"))
+	nr := NewNarReader(bytes.NewReader(nar))
+	_, err := nr.Next()
+	if err == nil {
+		t.Fatal("NAR with a file size of 2^63 was accepted")
+	}
+	_, err = nr.Read(make([]byte, 16))
+	if err != io.EOF {
+		t.Errorf("got %v reading after the error", err)
+	}
+}
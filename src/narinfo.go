@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// NarInfo is a parsed narinfo file. Unlike api.NarInfo it keeps all Sig
+// lines and the fields nix added after the schema was written.
+type NarInfo struct {
+	StorePath   string
+	URL         string
+	Compression string
+	FileHash    string
+	FileSize    uint64
+	NarHash     string
+	NarSize     uint64
+	References  []string
+	Deriver     string
+	System      string
+	Sigs        []string
+	CA          string
+}
+
+// ParseNarInfo parses the key value format of narinfo files. Unknown keys
+// are ignored like nix does.
+func ParseNarInfo(r io.Reader) (*NarInfo, error) {
+	info := &NarInfo{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, fmt.Errorf("Invalid narinfo line %q", line)
+		}
+
+		var err error
+		switch key {
+		case "StorePath":
+			info.StorePath = value
+		case "URL":
+			info.URL = value
+		case "Compression":
+			info.Compression = value
+		case "FileHash":
+			info.FileHash = value
+		case "FileSize":
+			info.FileSize, err = strconv.ParseUint(value, 10, 64)
+		case "NarHash":
+			info.NarHash = value
+		case "NarSize":
+			info.NarSize, err = strconv.ParseUint(value, 10, 64)
+		case "References":
+			info.References = strings.Fields(value)
+		case "Deriver":
+			info.Deriver = value
+		case "System":
+			info.System = value
+		case "Sig":
+			info.Sigs = append(info.Sigs, value)
+		case "CA":
+			info.CA = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid narinfo value for %s: %w", key, err)
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.StorePath == "" || info.URL == "" || info.NarHash == "" {
+		return nil, fmt.Errorf("Narinfo misses mandatory fields")
+	}
+	// nix defaults to bzip2 for old narinfos without a Compression field
+	if info.Compression == "" {
+		info.Compression = "bzip2"
+	}
+	return info, nil
+}
+
+// String formats the narinfo the way nix writes it.
+func (n *NarInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "StorePath: %s\n", n.StorePath)
+	fmt.Fprintf(&b, "URL: %s\n", n.URL)
+	fmt.Fprintf(&b, "Compression: %s\n", n.Compression)
+	if n.FileHash != "" {
+		fmt.Fprintf(&b, "FileHash: %s\n", n.FileHash)
+		fmt.Fprintf(&b, "FileSize: %d\n", n.FileSize)
+	}
+	fmt.Fprintf(&b, "NarHash: %s\n", n.NarHash)
+	fmt.Fprintf(&b, "NarSize: %d\n", n.NarSize)
+	fmt.Fprintf(&b, "References: %s\n", strings.Join(n.References, " "))
+	if n.Deriver != "" {
+		fmt.Fprintf(&b, "Deriver: %s\n", n.Deriver)
+	}
+	if n.System != "" {
+		fmt.Fprintf(&b, "System: %s\n", n.System)
+	}
+	for _, sig := range n.Sigs {
+		fmt.Fprintf(&b, "Sig: %s\n", sig)
+	}
+	if n.CA != "" {
+		fmt.Fprintf(&b, "CA: %s\n", n.CA)
+	}
+	return b.String()
+}
+
+// Fingerprint returns what the signatures of a narinfo sign.
+func (n *NarInfo) Fingerprint() string {
+	narHash := n.NarHash
+	// old narinfos have base16 hashes, signatures always use base32
+	if hash, ok := strings.CutPrefix(narHash, "sha256:"); ok && len(hash) == 64 {
+		sum, err := hex.DecodeString(hash)
+		if err == nil {
+			narHash = "sha256:" + nixBase32(sum)
+		}
+	}
+	storeDir := path.Dir(n.StorePath)
+	refs := make([]string, len(n.References))
+	for i, ref := range n.References {
+		refs[i] = storeDir + "/" + ref
+	}
+	return fmt.Sprintf("1;%s;%s;%d;%s", n.StorePath, narHash, n.NarSize, strings.Join(refs, ","))
+}
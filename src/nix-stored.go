@@ -3,14 +3,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/semaphore"
 
 	"github.com/ChrisOboe/nix-stored/api"
@@ -36,12 +49,40 @@ func PanicHandlerMiddleware() api.StrictMiddlewareFunc {
 	}
 }
 
+// CacheSettings are the settings of a single cache. The unnamed default
+// cache is served at the root, named caches below /cache/{name}/ and
+// optionally at the root of their own host name.
+type CacheSettings struct {
+	Name                string
+	Host                string
+	StorePath           string
+	UserRead            Authentication
+	UserWrite           Authentication
+	Users               *UserDB
+	Tokens              *TokenStore
+	OIDC                *OIDC
+	ClientCerts         *ClientCertRules
+	TrustedKeys         PublicKeys
+	IndexDebugInfo      bool
+	Recompress          Recompression
+	CacheControl        CacheControl
+	Upstreams           []Upstream
+	UpstreamNegativeTTL time.Duration
+	ReplicateTo         []ReplicationTarget
+	// LocalStore is the socket of the nix daemon whose store is served
+	LocalStore            string
+	LocalStoreCompression Recompression
+	SigningKey            *SecretKey
+	CacheInfo             api.NixCacheInfo
+}
+
 type Settings struct {
-	StorePath       string
+	CacheSettings
 	ListenInterface string
-	UserRead        Authentication
-	UserWrite       Authentication
+	TLS             TLSSettings
+	ShutdownTimeout time.Duration
 	LogLevel        slog.Level
+	Caches          []CacheSettings
 }
 
 func defaultEnv(envVar string, def string) string {
@@ -52,38 +93,233 @@ func defaultEnv(envVar string, def string) string {
 	return def
 }
 
-func SettingsFromEnv() (Settings, error) {
-	rpassfile := os.Getenv("NIX_STORED_USER_READ_PASSFILE")
-	wpassfile := os.Getenv("NIX_STORED_USER_WRITE_PASSFILE")
+func boolEnv(envVar string, def bool) (bool, error) {
+	env := os.Getenv(envVar)
+	if env == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(env)
+	if err != nil {
+		return def, fmt.Errorf("Couldn't parse %s: %w", envVar, err)
+	}
+	return b, nil
+}
 
-	var ReadAuth Authentication
-	ReadAuth.User = os.Getenv("NIX_STORED_USER_READ")
+func intEnv(envVar string, def int) (int, error) {
+	env := os.Getenv(envVar)
+	if env == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(env)
+	if err != nil {
+		return def, fmt.Errorf("Couldn't parse %s: %w", envVar, err)
+	}
+	return i, nil
+}
 
-	var WriteAuth Authentication
-	WriteAuth.User = os.Getenv("NIX_STORED_USER_WRITE")
+// durationEnv parses a non-negative Go duration like 1h30m.
+func durationEnv(envVar string, def time.Duration) (time.Duration, error) {
+	env := os.Getenv(envVar)
+	if env == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(env)
+	if err != nil {
+		return def, fmt.Errorf("Couldn't parse %s: %w", envVar, err)
+	}
+	if d < 0 {
+		return def, fmt.Errorf("%s must not be negative", envVar)
+	}
+	return d, nil
+}
+
+// authFromEnv reads the credentials of a user from the environment. The
+// password is either given directly or read from a file.
+func authFromEnv(userVar string, def Authentication) (Authentication, error) {
+	auth := Authentication{User: os.Getenv(userVar)}
+	if auth.User == "" {
+		return def, nil
+	}
 
-	if rpassfile != "" {
-		slog.Debug("Reading read user password file", "path", rpassfile)
-		rpass, err := os.ReadFile(rpassfile)
+	passfile := os.Getenv(userVar + "_PASSFILE")
+	if passfile != "" {
+		slog.Debug("Reading password file", "path", passfile)
+		pass, err := os.ReadFile(passfile)
 		if err != nil {
-			return Settings{}, fmt.Errorf("Couldn't read read passfile: %w", err)
+			return Authentication{}, fmt.Errorf("Couldn't read %s: %w", userVar+"_PASSFILE", err)
 		}
-		ReadAuth.Pass = string(rpass)
+		auth.Pass = string(pass)
+	} else if pass, ok := os.LookupEnv(userVar + "_PASS"); ok {
+		auth.Pass = pass
 	} else {
-		ReadAuth.Pass = os.Getenv("NIX_STORED_USER_READ_PASS")
+		pass, err := credential(userVar + "_PASS")
+		if err != nil {
+			return Authentication{}, fmt.Errorf("Couldn't read credential %s: %w", userVar+"_PASS", err)
+		}
+		auth.Pass = pass
 	}
+	return auth, nil
+}
 
-	if wpassfile != "" {
-		slog.Debug("Reading write user password file", "path", wpassfile)
-		wpass, err := os.ReadFile(wpassfile)
+// signingKeyFromEnv reads the secret key from the file in keyVar_FILE or the
+// systemd credential keyVar.
+func signingKeyFromEnv(keyVar string, def *SecretKey) (*SecretKey, error) {
+	var key string
+	keyFile := os.Getenv(keyVar + "_FILE")
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
 		if err != nil {
-			return Settings{}, fmt.Errorf("Couldn't read read passfile: %w", err)
+			return nil, fmt.Errorf("Couldn't read %s: %w", keyVar+"_FILE", err)
 		}
-		WriteAuth.Pass = string(wpass)
+		key = string(data)
 	} else {
-		WriteAuth.Pass = os.Getenv("NIX_STORED_USER_WRITE_PASS")
+		var err error
+		key, err = credential(keyVar)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read credential %s: %w", keyVar, err)
+		}
+	}
+	if key == "" {
+		return def, nil
+	}
+	return ParseSecretKey(key)
+}
+
+// CacheSettingsFromEnv reads the settings of a cache from the environment
+// variables starting with prefix. Unset variables fall back to def.
+func CacheSettingsFromEnv(prefix string, def CacheSettings) (CacheSettings, error) {
+	cs := def
+	var err error
+
+	cs.StorePath = defaultEnv(prefix+"PATH", def.StorePath)
+
+	cs.UserRead, err = authFromEnv(prefix+"USER_READ", def.UserRead)
+	if err != nil {
+		return CacheSettings{}, err
+	}
+	cs.UserWrite, err = authFromEnv(prefix+"USER_WRITE", def.UserWrite)
+	if err != nil {
+		return CacheSettings{}, err
+	}
+
+	usersFile := os.Getenv(prefix + "USERS_FILE")
+	if usersFile != "" {
+		cs.Users, err = LoadUserDB(usersFile)
+		if err != nil {
+			return CacheSettings{}, fmt.Errorf("Couldn't load users: %w", err)
+		}
+	}
+
+	oidcFile := os.Getenv(prefix + "OIDC_FILE")
+	if oidcFile != "" {
+		cs.OIDC, err = LoadOIDC(oidcFile)
+		if err != nil {
+			return CacheSettings{}, fmt.Errorf("Couldn't load OIDC issuers: %w", err)
+		}
+	}
+
+	clientCertsFile := os.Getenv(prefix + "CLIENT_CERTS_FILE")
+	if clientCertsFile != "" {
+		cs.ClientCerts, err = LoadClientCertRules(clientCertsFile)
+		if err != nil {
+			return CacheSettings{}, fmt.Errorf("Couldn't load client certificate rules: %w", err)
+		}
+	}
+
+	keys, ok := os.LookupEnv(prefix + "TRUSTED_PUBLIC_KEYS")
+	if ok {
+		cs.TrustedKeys, err = ParsePublicKeys(keys)
+		if err != nil {
+			return CacheSettings{}, fmt.Errorf("Couldn't parse trusted public keys: %w", err)
+		}
+	}
+
+	cs.IndexDebugInfo, err = boolEnv(prefix+"INDEX_DEBUG_INFO", def.IndexDebugInfo)
+	if err != nil {
+		return CacheSettings{}, err
+	}
+
+	upstreams, ok := os.LookupEnv(prefix + "UPSTREAMS")
+	if ok {
+		cs.Upstreams, err = ParseUpstreams(upstreams)
+		if err != nil {
+			return CacheSettings{}, fmt.Errorf("Couldn't parse upstreams: %w", err)
+		}
+	}
+
+	cs.UpstreamNegativeTTL, err = durationEnv(prefix+"UPSTREAM_NEGATIVE_TTL", def.UpstreamNegativeTTL)
+	if err != nil {
+		return CacheSettings{}, err
+	}
+
+	replicateTo, ok := os.LookupEnv(prefix + "REPLICATE_TO")
+	if ok {
+		cs.ReplicateTo, err = ParseReplicationTargets(replicateTo)
+		if err != nil {
+			return CacheSettings{}, fmt.Errorf("Couldn't parse replication targets: %w", err)
+		}
+	}
+
+	cs.LocalStore = defaultEnv(prefix+"LOCAL_STORE", def.LocalStore)
+	localStoreCompression, ok := os.LookupEnv(prefix + "LOCAL_STORE_COMPRESSION")
+	if ok {
+		cs.LocalStoreCompression, err = ParseRecompression(localStoreCompression)
+		if err != nil {
+			return CacheSettings{}, err
+		}
+	}
+	cs.SigningKey, err = signingKeyFromEnv(prefix+"SIGNING_KEY", def.SigningKey)
+	if err != nil {
+		return CacheSettings{}, err
+	}
+
+	recompress, ok := os.LookupEnv(prefix + "RECOMPRESS")
+	if ok {
+		cs.Recompress, err = ParseRecompression(recompress)
+		if err != nil {
+			return CacheSettings{}, err
+		}
 	}
 
+	cs.CacheControl.NarMaxAge, err = durationEnv(prefix+"NAR_MAX_AGE", def.CacheControl.NarMaxAge)
+	if err != nil {
+		return CacheSettings{}, err
+	}
+	cs.CacheControl.NarInfoMaxAge, err = durationEnv(prefix+"NARINFO_MAX_AGE", def.CacheControl.NarInfoMaxAge)
+	if err != nil {
+		return CacheSettings{}, err
+	}
+	cs.CacheControl.NegativeMaxAge, err = durationEnv(prefix+"NEGATIVE_MAX_AGE", def.CacheControl.NegativeMaxAge)
+	if err != nil {
+		return CacheSettings{}, err
+	}
+	// shared caches must not hand out what needs authentication
+	cs.CacheControl.Private = cs.Auth().enabled()
+
+	cs.CacheInfo.StoreDir = defaultEnv(prefix+"STORE_DIR", def.CacheInfo.StoreDir)
+	if !strings.HasPrefix(cs.CacheInfo.StoreDir, "/") || (len(cs.CacheInfo.StoreDir) > 1 && strings.HasSuffix(cs.CacheInfo.StoreDir, "/")) {
+		return CacheSettings{}, fmt.Errorf("%sSTORE_DIR must be an absolute path without trailing slash", prefix)
+	}
+	cs.CacheInfo.Priority, err = intEnv(prefix+"PRIORITY", def.CacheInfo.Priority)
+	if err != nil {
+		return CacheSettings{}, err
+	}
+	if cs.CacheInfo.Priority < 0 {
+		return CacheSettings{}, fmt.Errorf("%sPRIORITY must not be negative", prefix)
+	}
+	wantMassQuery, err := boolEnv(prefix+"WANT_MASS_QUERY", def.CacheInfo.WantMassQuery != 0)
+	if err != nil {
+		return CacheSettings{}, err
+	}
+	cs.CacheInfo.WantMassQuery = 0
+	if wantMassQuery {
+		cs.CacheInfo.WantMassQuery = 1
+	}
+
+	return cs, nil
+}
+
+func SettingsFromEnv() (Settings, error) {
 	loglevel_str := os.Getenv("NIX_STORED_LOG_LEVEL")
 	var loglevel slog.Level
 	switch strings.ToUpper(loglevel_str) {
@@ -99,16 +335,87 @@ func SettingsFromEnv() (Settings, error) {
 		loglevel = slog.LevelInfo
 	}
 
+	defaultCache, err := CacheSettingsFromEnv("NIX_STORED_", CacheSettings{
+		StorePath:             "/var/lib/nixStored",
+		UpstreamNegativeTTL:   time.Hour,
+		LocalStoreCompression: Recompression{Compression: "zstd", Level: 3},
+		CacheControl: CacheControl{
+			NarMaxAge:      365 * 24 * time.Hour,
+			NarInfoMaxAge:  time.Hour,
+			NegativeMaxAge: time.Minute,
+		},
+		CacheInfo: api.NixCacheInfo{
+			StoreDir:      "/nix/store",
+			Priority:      30,
+			WantMassQuery: 1,
+		},
+	})
+	if err != nil {
+		return Settings{}, err
+	}
+	// tokens of all caches are kept by the default cache, they can be
+	// limited to a single cache
+	defaultCache.Tokens = NewTokenStore(defaultCache.StorePath + "/tokens")
+
+	// named caches default to the settings of the default cache, so they
+	// are never less protected than it by accident. Where their paths come
+	// from and go to isn't inherited, that would mix caches.
+	var caches []CacheSettings
+	for _, name := range strings.Split(os.Getenv("NIX_STORED_CACHES"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !cacheNameRegex.MatchString(name) {
+			return Settings{}, fmt.Errorf("Invalid cache name %q", name)
+		}
+		prefix := "NIX_STORED_CACHE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+
+		def := defaultCache
+		def.StorePath = defaultCache.StorePath + "/caches/" + name
+		def.Upstreams = nil
+		def.ReplicateTo = nil
+		def.LocalStore = ""
+		def.SigningKey = nil
+		cache, err := CacheSettingsFromEnv(prefix, def)
+		if err != nil {
+			return Settings{}, fmt.Errorf("Cache %s: %w", name, err)
+		}
+		cache.Name = name
+		cache.Host = os.Getenv(prefix + "HOST")
+		caches = append(caches, cache)
+	}
+
+	tlsSettings, err := TLSSettingsFromEnv()
+	if err != nil {
+		return Settings{}, err
+	}
+	for _, cs := range append([]CacheSettings{defaultCache}, caches...) {
+		if cs.ClientCerts != nil && tlsSettings.ClientCA == "" {
+			return Settings{}, fmt.Errorf("Client certificate rules need NIX_STORED_TLS_CLIENT_CA")
+		}
+	}
+
+	shutdownTimeout, err := durationEnv("NIX_STORED_SHUTDOWN_TIMEOUT", time.Minute)
+	if err != nil {
+		return Settings{}, err
+	}
+
 	return Settings{
-		StorePath:       defaultEnv("NIX_STORED_PATH", "/var/lib/nixStored"),
+		CacheSettings:   defaultCache,
+		ShutdownTimeout: shutdownTimeout,
+		TLS:             tlsSettings,
 		ListenInterface: defaultEnv("NIX_STORED_LISTEN_INTERFACE", "127.0.0.1:8100"),
-		UserRead:        ReadAuth,
-		UserWrite:       WriteAuth,
 		LogLevel:        loglevel,
+		Caches:          caches,
 	}, nil
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	earlyConsoleHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
 	slog.SetDefault(slog.New(earlyConsoleHandler))
 
@@ -122,62 +429,236 @@ func main() {
 	consoleHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: s.LogLevel})
 	slog.SetDefault(slog.New(consoleHandler))
 
-	ns := NixStored{StorePath: s.StorePath, limit: semaphore.NewWeighted(32)}
-	// create dirs
-	err = os.MkdirAll(s.StorePath+"/nar", 0770)
+	// background work of the caches, like downloads from upstreams
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	router, err := NewCacheRouter(background, s, semaphore.NewWeighted(32))
 	if err != nil {
-		slog.Error("Couldn't create dir", "error", err)
+		slog.Error("Couldn't set up caches", "error", err)
 		return
 	}
 
-	options := api.StrictHTTPServerOptions{
-		RequestErrorHandlerFunc: func(w http.ResponseWriter, r *http.Request, err error) {
-			slog.Warn("Request Error", "error", err)
-			w.WriteHeader(http.StatusBadRequest)
-			_, e := w.Write([]byte(err.Error()))
-			if e != nil {
-				slog.Error("Couldn't write response", "error", err)
-			}
-		},
-		ResponseErrorHandlerFunc: func(w http.ResponseWriter, r *http.Request, err error) {
-			slog.Error("Response Error", "error", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			_, e := w.Write([]byte(err.Error()))
-			if e != nil {
-				slog.Error("Couldn't write response", "error", err)
+	tlsConfig, err := s.TLS.TLSConfig()
+	if err != nil {
+		slog.Error("Couldn't set up TLS", "error", err)
+		return
+	}
+	listeners, err := Listen(s.ListenInterface)
+	if err != nil {
+		slog.Error("Couldn't listen", "error", err)
+		return
+	}
+
+	// track requests, so aborted uploads can clean up before we exit
+	var inflight sync.WaitGroup
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflight.Add(1)
+		defer inflight.Done()
+		router.ServeHTTP(w, r)
+	})
+
+	server := &http.Server{
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	// h2c is for proxies in front of us that speak HTTP/2 without TLS,
+	// with TLS HTTP/2 is negotiated via ALPN
+	if tlsConfig == nil && s.TLS.H2C {
+		server.Handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		slog.Info("Starting http server", "interface", l.Addr().String(), "tls", tlsConfig != nil, "h2c", s.TLS.H2C)
+		go func() {
+			if tlsConfig != nil {
+				errs <- server.ServeTLS(l, "", "")
+			} else {
+				errs <- server.Serve(l)
 			}
-		},
+		}()
 	}
+	sdNotify("READY=1")
 
-	apiHandler := api.NewStrictHandlerWithOptions(ns, []api.StrictMiddlewareFunc{PanicHandlerMiddleware(), BasicAuthMiddleware(s.UserRead, s.UserWrite), LogMiddleware()}, options)
-	http.Handle("/", api.Handler(apiHandler))
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			s.ReloadAuth()
+		}
+	}()
 
-	slog.Info("Starting http server", "interface", s.ListenInterface)
-	err = http.ListenAndServe(s.ListenInterface, nil)
-	if err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	go sdWatchdog(ctx)
+
+	select {
+	case err = <-errs:
 		slog.Error("Couldn't create webserver", "error", err)
-		return
+	case <-ctx.Done():
+		slog.Info("Stopping")
+	}
+	sdNotify("STOPPING=1")
+
+	// stop accepting connections and give running transfers some time.
+	// Uploads that don't make it are aborted and their temporary files
+	// removed.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Warn("Aborting unfinished requests", "error", err)
+		server.Close()
+		inflight.Wait()
 	}
+	// replication, recompression, downloads and jobs stop as well, a
+	// recompression that is running is finished first
+	stopBackground()
+	router.Wait()
+	slog.Info("Stopped")
 }
 
 type NixStored struct {
-	StorePath string
-	limit     *semaphore.Weighted
+	Name           string
+	StorePath      string
+	CacheInfo      api.NixCacheInfo
+	TrustedKeys    PublicKeys
+	IndexDebugInfo bool
+	Recompress     Recompression
+	CacheControl   CacheControl
+	limit          *semaphore.Weighted
+	recompress     chan<- string
+	proxy          *Proxy
+	workers        *workers
+	replicators    []*Replicator
+	prefetches     *jobList[*PrefetchJob]
+	syncs          *jobList[*SyncJob]
+	local          *LocalStore
+	tokens         *TokenStore
 }
 
 // Get the build logs for a particular deriver. This path exists if this binary cache is hydrated from Hydra.
 // (GET /log/{deriver})
 func (n NixStored) GetDeriverBuildLog(ctx context.Context, request api.GetDeriverBuildLogRequestObject) (api.GetDeriverBuildLogResponseObject, error) {
-	// not yet implemented
-	slog.Warn("GetDeriverBuildLog was called")
-	return api.GetDeriverBuildLog501Response{}, nil
+	if !ValidDeriver(request.Deriver) {
+		return api.GetDeriverBuildLog404Response{}, nil
+	}
+	file, encoding, err := OpenBuildLog(n.StorePath+"/log", request.Deriver)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return api.GetDeriverBuildLog404Response{}, nil
+		} else {
+			slog.Error("Couldn't open log", "deriver", request.Deriver, "error", err)
+			return api.GetDeriverBuildLog500Response{}, nil
+		}
+	}
+	err = n.limit.Acquire(ctx, 1)
+	if err != nil {
+		file.Close()
+		return api.GetDeriverBuildLog503Response{}, nil
+	}
+	defer n.limit.Release(1)
+
+	if acceptsEncoding(request.Params.AcceptEncoding, encoding) {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			slog.Error("Couldn't get fileinfo", "file", file.Name(), "error", err)
+			return api.GetDeriverBuildLog500Response{}, nil
+		}
+		return buildLogResponse{
+			Body:            file,
+			ContentEncoding: encoding,
+			ContentLength:   info.Size(),
+		}, nil
+	}
+
+	body, err := decodeContentEncoding(file, encoding)
+	if err != nil {
+		file.Close()
+		slog.Error("Couldn't decode log", "file", file.Name(), "error", err)
+		return api.GetDeriverBuildLog500Response{}, nil
+	}
+	return buildLogResponse{
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{body, file},
+	}, nil
+}
+
+// Upload the build log of a deriver
+// (PUT /log/{deriver})
+func (n NixStored) PutLogDeriver(ctx context.Context, request api.PutLogDeriverRequestObject) (api.PutLogDeriverResponseObject, error) {
+	if !ValidDeriver(request.Deriver) {
+		slog.Warn("Rejected log for invalid deriver", "deriver", request.Deriver)
+		return api.PutLogDeriver400Response{}, nil
+	}
+
+	encoding := ""
+	if request.Params.ContentEncoding != nil {
+		encoding = string(*request.Params.ContentEncoding)
+	}
+
+	err := n.limit.Acquire(ctx, 1)
+	if err != nil {
+		return api.PutLogDeriver503Response{}, nil
+	}
+	defer n.limit.Release(1)
+	err = StoreBuildLog(n.StorePath+"/log", request.Deriver, request.Body, encoding)
+	if err != nil {
+		if errors.Is(err, ErrInvalidLog) {
+			slog.Warn("Rejected invalid log", "deriver", request.Deriver, "error", err)
+			return api.PutLogDeriver400Response{}, nil
+		}
+		slog.Error("Couldn't store log", "deriver", request.Deriver, "error", err)
+		return api.PutLogDeriver500Response{}, nil
+	}
+
+	return api.PutLogDeriver201Response{}, nil
 }
 
 // Get the compressed NAR object
 // (GET /nar/{fileHash}.nar.{compression})
 func (n NixStored) GetCompressedNar(ctx context.Context, request api.GetCompressedNarRequestObject) (api.GetCompressedNarResponseObject, error) {
+	if !ValidNarFile(request.FileHash, request.Compression) {
+		return api.GetCompressedNar404Response{}, nil
+	}
 	filename := fmt.Sprintf("%s/nar/%s.nar.%s", n.StorePath, request.FileHash, request.Compression)
 	file, err := os.Open(filename)
+	if os.IsNotExist(err) && n.local != nil {
+		body, size, err := n.local.OpenNar(fmt.Sprintf("%s.nar.%s", request.FileHash, request.Compression))
+		if err == nil {
+			err = n.limit.Acquire(ctx, 1)
+			if err != nil {
+				body.Close()
+				return api.GetCompressedNar503Response{}, nil
+			}
+			defer n.limit.Release(1)
+			return streamResponse{body, size, n.CacheControl.Nar()}, nil
+		}
+		if !os.IsNotExist(err) {
+			slog.Error("Couldn't serve NAR from the local store", "file", filename, "error", err)
+			return api.GetCompressedNar500Response{}, nil
+		}
+	}
+	if os.IsNotExist(err) && n.proxy.HasUpstreams() {
+		body, size, err := n.proxy.OpenNar(fmt.Sprintf("%s.nar.%s", request.FileHash, request.Compression))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return api.GetCompressedNar404Response{}, nil
+			}
+			slog.Error("Couldn't fetch NAR from upstream", "file", filename, "error", err)
+			return api.GetCompressedNar500Response{}, nil
+		}
+		err = n.limit.Acquire(ctx, 1)
+		if err != nil {
+			body.Close()
+			return api.GetCompressedNar503Response{}, nil
+		}
+		defer n.limit.Release(1)
+		return streamResponse{body, size, n.CacheControl.Nar()}, nil
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			return api.GetCompressedNar404Response{}, nil
@@ -186,23 +667,28 @@ func (n NixStored) GetCompressedNar(ctx context.Context, request api.GetCompress
 			return api.GetCompressedNar500Response{}, nil
 		}
 	}
-	n.limit.Acquire(ctx, 1)
+	err = n.limit.Acquire(ctx, 1)
+	if err != nil {
+		file.Close()
+		return api.GetCompressedNar503Response{}, nil
+	}
 	defer n.limit.Release(1)
-	info, err := file.Stat()
+	// NARs are content addressed, so the file name is a strong ETag
+	response, err := newFileResponse(ctx, file, "application/x-nix-nar", n.CacheControl.Nar(), fmt.Sprintf("%s.nar.%s", request.FileHash, request.Compression))
 	if err != nil {
-		slog.Error("Couldn't get fileinfo", "file", filename, "error", err)
+		file.Close()
+		slog.Error("Couldn't serve file", "file", filename, "error", err)
 		return api.GetCompressedNar500Response{}, nil
 	}
-
-	return api.GetCompressedNar200ApplicationxNixNarResponse{
-		Body:          file,
-		ContentLength: info.Size(),
-	}, nil
+	return response, nil
 }
 
 // Check if the NAR is there
 // (HEAD /nar/{fileHash}.nar.{compression})
 func (n NixStored) HeadNarFileHashNarCompression(ctx context.Context, request api.HeadNarFileHashNarCompressionRequestObject) (api.HeadNarFileHashNarCompressionResponseObject, error) {
+	if !ValidNarFile(request.FileHash, request.Compression) {
+		return api.HeadNarFileHashNarCompression404Response{}, nil
+	}
 	filename := fmt.Sprintf("%s/nar/%s.nar.%s", n.StorePath, request.FileHash, request.Compression)
 	_, err := os.Stat(filename)
 	if err != nil {
@@ -219,39 +705,471 @@ func (n NixStored) HeadNarFileHashNarCompression(ctx context.Context, request ap
 // Upload NAR
 // (PUT /nar/{fileHash}.nar.{compression})
 func (n NixStored) PutNarFileHashNarCompression(ctx context.Context, request api.PutNarFileHashNarCompressionRequestObject) (api.PutNarFileHashNarCompressionResponseObject, error) {
+	if !ValidNarFile(request.FileHash, request.Compression) {
+		slog.Warn("Rejected invalid NAR file name", "hash", request.FileHash, "compression", request.Compression)
+		return api.PutNarFileHashNarCompression400Response{}, nil
+	}
 	filename := fmt.Sprintf("%s/nar/%s.nar.%s", n.StorePath, request.FileHash, request.Compression)
-	file, err := os.Create(filename)
+	err := n.limit.Acquire(ctx, 1)
 	if err != nil {
-		slog.Error("Couldn't open file", "file", filename, "error", err)
-		return api.PutNarFileHashNarCompression500Response{}, nil
+		return api.PutNarFileHashNarCompression503Response{}, nil
 	}
-	defer file.Close()
-	n.limit.Acquire(ctx, 1)
 	defer n.limit.Release(1)
-	_, err = io.Copy(file, request.Body)
+	err = StoreUpload(filename, request.Body)
+	if errors.Is(err, ErrFileHashMismatch) {
+		slog.Warn("Rejected NAR", "error", err)
+		return api.PutNarFileHashNarCompression400Response{}, nil
+	}
 	if err != nil {
 		slog.Error("Couln't serve request", "error", err)
 		return api.PutNarFileHashNarCompression500Response{}, nil
 	}
 
+	n.narStored(fmt.Sprintf("%s.nar.%s", request.FileHash, request.Compression))
 	return api.PutNarFileHashNarCompression201Response{}, nil
 }
 
+// Get the uncompressed NAR object
+// (GET /nar/{fileHash}.nar)
+func (n NixStored) GetUncompressedNar(ctx context.Context, request api.GetUncompressedNarRequestObject) (api.GetUncompressedNarResponseObject, error) {
+	if !ValidNarFile(request.FileHash, "") {
+		return api.GetUncompressedNar404Response{}, nil
+	}
+	filename := fmt.Sprintf("%s/nar/%s.nar", n.StorePath, request.FileHash)
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) && n.local != nil {
+		body, size, err := n.local.OpenNar(request.FileHash + ".nar")
+		if err == nil {
+			err = n.limit.Acquire(ctx, 1)
+			if err != nil {
+				body.Close()
+				return api.GetUncompressedNar503Response{}, nil
+			}
+			defer n.limit.Release(1)
+			return streamResponse{body, size, n.CacheControl.Nar()}, nil
+		}
+		if !os.IsNotExist(err) {
+			slog.Error("Couldn't serve NAR from the local store", "file", filename, "error", err)
+			return api.GetUncompressedNar500Response{}, nil
+		}
+	}
+	if os.IsNotExist(err) && n.proxy.HasUpstreams() {
+		body, size, err := n.proxy.OpenNar(request.FileHash + ".nar")
+		if err != nil {
+			if os.IsNotExist(err) {
+				return api.GetUncompressedNar404Response{}, nil
+			}
+			slog.Error("Couldn't fetch NAR from upstream", "file", filename, "error", err)
+			return api.GetUncompressedNar500Response{}, nil
+		}
+		err = n.limit.Acquire(ctx, 1)
+		if err != nil {
+			body.Close()
+			return api.GetUncompressedNar503Response{}, nil
+		}
+		defer n.limit.Release(1)
+		return streamResponse{body, size, n.CacheControl.Nar()}, nil
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return api.GetUncompressedNar404Response{}, nil
+		} else {
+			slog.Error("Couldn't open file", "file", filename, "error", err)
+			return api.GetUncompressedNar500Response{}, nil
+		}
+	}
+	err = n.limit.Acquire(ctx, 1)
+	if err != nil {
+		file.Close()
+		return api.GetUncompressedNar503Response{}, nil
+	}
+	defer n.limit.Release(1)
+	response, err := newFileResponse(ctx, file, "application/x-nix-nar", n.CacheControl.Nar(), request.FileHash+".nar")
+	if err != nil {
+		file.Close()
+		slog.Error("Couldn't serve file", "file", filename, "error", err)
+		return api.GetUncompressedNar500Response{}, nil
+	}
+	return response, nil
+}
+
+// Checks if the uncompressed NAR is there
+// (HEAD /nar/{fileHash}.nar)
+func (n NixStored) DoesUncompressedNarExist(ctx context.Context, request api.DoesUncompressedNarExistRequestObject) (api.DoesUncompressedNarExistResponseObject, error) {
+	if !ValidNarFile(request.FileHash, "") {
+		return api.DoesUncompressedNarExist404Response{}, nil
+	}
+	filename := fmt.Sprintf("%s/nar/%s.nar", n.StorePath, request.FileHash)
+	_, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return api.DoesUncompressedNarExist404Response{}, nil
+		} else {
+			slog.Error("Couldn't open file", "file", filename, "error", err)
+			return api.DoesUncompressedNarExist500Response{}, nil
+		}
+	}
+	return api.DoesUncompressedNarExist200Response{}, nil
+}
+
+// Uploads an uncompressed NAR, as written by nix with compression=none
+// (PUT /nar/{fileHash}.nar)
+func (n NixStored) PutUncompressedNar(ctx context.Context, request api.PutUncompressedNarRequestObject) (api.PutUncompressedNarResponseObject, error) {
+	if !ValidNarFile(request.FileHash, "") {
+		slog.Warn("Rejected invalid NAR file name", "hash", request.FileHash)
+		return api.PutUncompressedNar400Response{}, nil
+	}
+	filename := fmt.Sprintf("%s/nar/%s.nar", n.StorePath, request.FileHash)
+	err := n.limit.Acquire(ctx, 1)
+	if err != nil {
+		return api.PutUncompressedNar503Response{}, nil
+	}
+	defer n.limit.Release(1)
+	err = StoreUpload(filename, request.Body)
+	if errors.Is(err, ErrFileHashMismatch) {
+		slog.Warn("Rejected NAR", "error", err)
+		return api.PutUncompressedNar400Response{}, nil
+	}
+	if err != nil {
+		slog.Error("Couln't serve request", "error", err)
+		return api.PutUncompressedNar500Response{}, nil
+	}
+
+	n.narStored(request.FileHash + ".nar")
+	return api.PutUncompressedNar201Response{}, nil
+}
+
+// enqueueReplication passes a path fetched from elsewhere on to the
+// replication targets.
+func (n NixStored) enqueueReplication(storePath string) {
+	for _, r := range n.replicators {
+		r.Enqueue(path.Base(storePath)[:32])
+	}
+}
+
+// narStored is called after a NAR was uploaded successfully.
+func (n NixStored) narStored(narFile string) {
+	if n.IndexDebugInfo {
+		n.workers.Go(func(context.Context) {
+			err := IndexBuildIDs(n.StorePath, narFile)
+			if err != nil {
+				slog.Warn("Couldn't index build ids", "file", narFile, "error", err)
+			}
+		})
+	}
+}
+
 // Get information about this Nix binary cache
 // (GET /nix-cache-info)
 func (n NixStored) GetNixCacheInfo(ctx context.Context, request api.GetNixCacheInfoRequestObject) (api.GetNixCacheInfoResponseObject, error) {
-	return api.GetNixCacheInfo200JSONResponse{
-		Priority:      30,
-		StoreDir:      "/nix/store",
-		WantMassQuery: 1,
+	body := fmt.Sprintf("StoreDir: %s\nWantMassQuery: %d\nPriority: %d\n", n.CacheInfo.StoreDir, n.CacheInfo.WantMassQuery, n.CacheInfo.Priority)
+	return api.GetNixCacheInfo200TextxNixCacheInfoResponse{
+		Body:          strings.NewReader(body),
+		ContentLength: int64(len(body)),
+	}, nil
+}
+
+// List the narinfos of this cache
+// (GET /narinfos)
+func (n NixStored) ListNarInfos(ctx context.Context, request api.ListNarInfosRequestObject) (api.ListNarInfosResponseObject, error) {
+	return narInfoListResponse{n.StorePath}, nil
+}
+
+// Copy the paths missing in this cache or a remote cache
+// (POST /sync)
+func (n NixStored) Sync(ctx context.Context, request api.SyncRequestObject) (api.SyncResponseObject, error) {
+	remotes, err := ParseUpstreams(request.Body.Remote)
+	if err != nil || len(remotes) != 1 {
+		slog.Warn("Rejected sync", "error", err)
+		return api.Sync400Response{}, nil
+	}
+	opts := SyncOptions{Remote: remotes[0], Push: true, Pull: true}
+	if request.Body.Direction != nil {
+		opts.Push = *request.Body.Direction != api.Pull
+		opts.Pull = *request.Body.Direction != api.Push
+	}
+	if request.Body.System != nil {
+		opts.System = *request.Body.System
+	}
+	if request.Body.Name != nil {
+		opts.Name = *request.Body.Name
+	}
+	if request.Body.Roots != nil {
+		opts.Roots = *request.Body.Roots
+	}
+	if request.Body.DryRun != nil {
+		opts.DryRun = *request.Body.DryRun
+	}
+	err = opts.Validate()
+	if err != nil {
+		slog.Warn("Rejected sync", "remote", opts.Remote, "error", err)
+		return api.Sync400Response{}, nil
+	}
+
+	job, err := StartSync(n.workers, n.proxy, opts, n.enqueueReplication)
+	if err != nil {
+		slog.Error("Couldn't start sync", "remote", opts.Remote, "error", err)
+		return api.Sync500Response{}, nil
+	}
+	n.syncs.add(job.Status().Id, job)
+	return api.Sync202JSONResponse(job.Status()), nil
+}
+
+// Get the progress of a sync
+// (GET /sync/{id})
+func (n NixStored) GetSync(ctx context.Context, request api.GetSyncRequestObject) (api.GetSyncResponseObject, error) {
+	job, err := n.syncs.get(request.Id)
+	if err != nil {
+		return api.GetSync404Response{}, nil
+	}
+	return api.GetSync200JSONResponse(job.Status()), nil
+}
+
+// Cancel a sync
+// (DELETE /sync/{id})
+func (n NixStored) CancelSync(ctx context.Context, request api.CancelSyncRequestObject) (api.CancelSyncResponseObject, error) {
+	job, err := n.syncs.get(request.Id)
+	if err != nil {
+		return api.CancelSync404Response{}, nil
+	}
+	job.Cancel()
+	<-job.Done()
+	return api.CancelSync200JSONResponse(job.Status()), nil
+}
+
+// Fetch the closures of store paths from the upstreams
+// (POST /prefetch)
+func (n NixStored) StartPrefetch(ctx context.Context, request api.StartPrefetchRequestObject) (api.StartPrefetchResponseObject, error) {
+	job, err := StartPrefetch(n.workers, n.proxy, request.Body.Paths, n.enqueueReplication)
+	if err != nil {
+		slog.Warn("Rejected prefetch", "paths", request.Body.Paths, "error", err)
+		return api.StartPrefetch400Response{}, nil
+	}
+	n.prefetches.add(job.Status().Id, job)
+	return api.StartPrefetch202JSONResponse(job.Status()), nil
+}
+
+// Get the progress of a prefetch
+// (GET /prefetch/{id})
+func (n NixStored) GetPrefetch(ctx context.Context, request api.GetPrefetchRequestObject) (api.GetPrefetchResponseObject, error) {
+	job, err := n.prefetches.get(request.Id)
+	if err != nil {
+		return api.GetPrefetch404Response{}, nil
+	}
+	return api.GetPrefetch200JSONResponse(job.Status()), nil
+}
+
+// Cancel a prefetch
+// (DELETE /prefetch/{id})
+func (n NixStored) CancelPrefetch(ctx context.Context, request api.CancelPrefetchRequestObject) (api.CancelPrefetchResponseObject, error) {
+	job, err := n.prefetches.get(request.Id)
+	if err != nil {
+		return api.CancelPrefetch404Response{}, nil
+	}
+	job.Cancel()
+	<-job.Done()
+	return api.CancelPrefetch200JSONResponse(job.Status()), nil
+}
+
+// Download the closure of a store path as one archive
+// (GET /closure/{storePathHash}.tar)
+func (n NixStored) GetClosure(ctx context.Context, request api.GetClosureRequestObject) (api.GetClosureResponseObject, error) {
+	if !storePathHashRegex.MatchString(request.StorePathHash) {
+		return api.GetClosure404Response{}, nil
+	}
+	paths, err := closurePaths(ctx, n.StorePath, request.StorePathHash)
+	if err != nil {
+		slog.Error("Couldn't resolve closure", "storepathhash", request.StorePathHash, "error", err)
+		return api.GetClosure500Response{}, nil
+	}
+	if len(paths) == 0 {
+		return api.GetClosure404Response{}, nil
+	}
+	err = n.limit.Acquire(ctx, 1)
+	if err != nil {
+		return api.GetClosure503Response{}, nil
+	}
+	defer n.limit.Release(1)
+	return closureResponse{
+		storePath: n.StorePath,
+		storeDir:  n.CacheInfo.StoreDir,
+		paths:     paths,
+		zstd:      request.Params.Compression != nil && *request.Params.Compression == api.GetClosureParamsCompressionZstd,
 	}, nil
 }
 
+// Upload closures as one archive
+// (POST /closure)
+func (n NixStored) IngestClosure(ctx context.Context, request api.IngestClosureRequestObject) (api.IngestClosureResponseObject, error) {
+	err := n.limit.Acquire(ctx, 1)
+	if err != nil {
+		return api.IngestClosure503Response{}, nil
+	}
+	defer n.limit.Release(1)
+	imported, err := IngestClosure(ctx, n.StorePath, n.CacheInfo.StoreDir, request.Body, n.narStored)
+	for _, storePath := range imported {
+		n.enqueueReplication(storePath)
+	}
+	if errors.Is(err, ErrInvalidClosure) {
+		slog.Warn("Rejected closure archive", "error", err)
+		return api.IngestClosure400Response{}, nil
+	}
+	if err != nil {
+		slog.Error("Couldn't import closure archive", "error", err)
+		return api.IngestClosure500Response{}, nil
+	}
+	if imported == nil {
+		imported = []string{}
+	}
+	return api.IngestClosure200JSONResponse{Imported: imported}, nil
+}
+
+// List the API tokens
+// (GET /tokens)
+func (n NixStored) ListTokens(ctx context.Context, request api.ListTokensRequestObject) (api.ListTokensResponseObject, error) {
+	infos, err := n.tokens.List(n.Name)
+	if err != nil {
+		slog.Error("Couldn't list tokens", "error", err)
+		return api.ListTokens500Response{}, nil
+	}
+	return api.ListTokens200JSONResponse(infos), nil
+}
+
+// Create an API token. Tokens created through a named cache are limited to
+// it.
+// (POST /tokens)
+func (n NixStored) CreateToken(ctx context.Context, request api.CreateTokenRequestObject) (api.CreateTokenResponseObject, error) {
+	req := *request.Body
+	if n.Name != "" {
+		if req.Cache != nil && *req.Cache != "" && *req.Cache != n.Name {
+			slog.Warn("Rejected token for another cache", "cache", *req.Cache)
+			return api.CreateToken400Response{}, nil
+		}
+		req.Cache = &n.Name
+	}
+	ttl, err := checkTokenRequest(req)
+	if err != nil {
+		slog.Warn("Rejected token request", "error", err)
+		return api.CreateToken400Response{}, nil
+	}
+	// a token can only hand on what it has itself
+	caller, ok := ctx.Value(tokenKey{}).(*Token)
+	if ok {
+		err = caller.checkDelegation(req, ttl)
+		if err != nil {
+			slog.Warn("Rejected token request", "error", err)
+			return api.CreateToken403Response{}, nil
+		}
+	}
+	secret, info, err := n.tokens.Create(req)
+	if err != nil {
+		slog.Error("Couldn't create token", "error", err)
+		return api.CreateToken500Response{}, nil
+	}
+	slog.Info("Created token", "id", info.Id, "scopes", info.Scopes, "expires", info.Expires)
+	return api.CreateToken201JSONResponse{Token: secret, Info: info}, nil
+}
+
+// Revoke an API token
+// (DELETE /tokens/{id})
+func (n NixStored) RevokeToken(ctx context.Context, request api.RevokeTokenRequestObject) (api.RevokeTokenResponseObject, error) {
+	err := n.tokens.Revoke(request.Id, n.Name)
+	if errors.Is(err, os.ErrNotExist) {
+		return api.RevokeToken404Response{}, nil
+	}
+	if err != nil {
+		slog.Error("Couldn't revoke token", "id", request.Id, "error", err)
+		return api.RevokeToken500Response{}, nil
+	}
+	slog.Info("Revoked token", "id", request.Id)
+	return api.RevokeToken204Response{}, nil
+}
+
 // Get the file listings for a particular store-path (once you expand the NAR).
 // (GET /{storePathHash}.ls)
 func (n NixStored) GetNarFileListing(ctx context.Context, request api.GetNarFileListingRequestObject) (api.GetNarFileListingResponseObject, error) {
-	slog.Warn("Get NarFileListing called")
-	return api.GetNarFileListing501Response{}, nil
+	if !storePathHashRegex.MatchString(request.StorePathHash) {
+		return api.GetNarFileListing404Response{}, nil
+	}
+	filename := fmt.Sprintf("%s/%s.ls", n.StorePath, request.StorePathHash)
+
+	err := n.limit.Acquire(ctx, 1)
+	if err != nil {
+		return api.GetNarFileListing503Response{}, nil
+	}
+	defer n.limit.Release(1)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return api.GetNarFileListing404Response{}, nil
+		} else {
+			slog.Error("Couldn't open file", "file", filename, "error", err)
+			return api.GetNarFileListing500Response{}, nil
+		}
+	}
+
+	listing, err := ParseFileListing(data)
+	if err != nil {
+		slog.Error("Stored listing is invalid", "file", filename, "error", err)
+		return api.GetNarFileListing500Response{}, nil
+	}
+
+	return api.GetNarFileListing200JSONResponse(listing), nil
+}
+
+// maxListingSize is the largest accepted file listing. Listings of NARs
+// with many files are a lot larger than narinfos.
+const maxListingSize = 64 << 20
+
+// Upload the file listing of a NAR
+// (PUT /{storePathHash}.ls)
+func (n NixStored) PutStorePathHashLs(ctx context.Context, request api.PutStorePathHashLsRequestObject) (api.PutStorePathHashLsResponseObject, error) {
+	if !storePathHashRegex.MatchString(request.StorePathHash) {
+		slog.Warn("Rejected listing with invalid store path hash", "storepathhash", request.StorePathHash)
+		return api.PutStorePathHashLs400Response{}, nil
+	}
+	filename := fmt.Sprintf("%s/%s.ls", n.StorePath, request.StorePathHash)
+
+	encoding := ""
+	if request.Params.ContentEncoding != nil {
+		encoding = string(*request.Params.ContentEncoding)
+	}
+	body, err := decodeContentEncoding(request.Body, encoding)
+	if err != nil {
+		slog.Warn("Couldn't decode listing", "file", filename, "error", err)
+		return api.PutStorePathHashLs400Response{}, nil
+	}
+	defer body.Close()
+
+	err = n.limit.Acquire(ctx, 1)
+	if err != nil {
+		return api.PutStorePathHashLs503Response{}, nil
+	}
+	defer n.limit.Release(1)
+	// the limit applies to the decoded listing, so a small compressed body
+	// can't fill the memory either
+	data, err := io.ReadAll(io.LimitReader(body, maxListingSize+1))
+	if err != nil {
+		slog.Warn("Couldn't read listing", "file", filename, "error", err)
+		return api.PutStorePathHashLs400Response{}, nil
+	}
+	if len(data) > maxListingSize {
+		slog.Warn("Rejected too large listing", "file", filename)
+		return api.PutStorePathHashLs400Response{}, nil
+	}
+	_, err = ParseFileListing(data)
+	if err != nil {
+		slog.Warn("Rejected invalid listing", "file", filename, "error", err)
+		return api.PutStorePathHashLs400Response{}, nil
+	}
+
+	err = os.WriteFile(filename, data, 0660)
+	if err != nil {
+		slog.Error("Couldn't write file", "file", filename, "error", err)
+		return api.PutStorePathHashLs500Response{}, nil
+	}
+
+	return api.PutStorePathHashLs201Response{}, nil
 }
 
 // Get the NarInfo for a particular path
@@ -260,27 +1178,48 @@ func (n NixStored) GetNarInfo(ctx context.Context, request api.GetNarInfoRequest
 	filename := fmt.Sprintf("%s/%s.narinfo", n.StorePath, request.StorePathHash)
 
 	file, err := os.Open(filename)
+	if os.IsNotExist(err) && n.local != nil {
+		info, err := n.local.NarInfo(request.StorePathHash)
+		if err != nil {
+			slog.Error("Couldn't query the local store", "storepathhash", request.StorePathHash, "error", err)
+			return api.GetNarInfo500Response{}, nil
+		}
+		if info != nil {
+			return narInfoResponse{info.String(), n.CacheControl.NarInfo()}, nil
+		}
+	}
+	if os.IsNotExist(err) && n.proxy.HasUpstreams() {
+		info, err := n.proxy.FetchNarInfo(request.StorePathHash)
+		if err == nil {
+			return narInfoResponse{info, n.CacheControl.NarInfo()}, nil
+		}
+		if !os.IsNotExist(err) {
+			slog.Error("Couldn't fetch narinfo", "storepathhash", request.StorePathHash, "error", err)
+			return api.GetNarInfo500Response{}, nil
+		}
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
-			return api.GetNarInfo404Response{}, nil
+			return notFoundResponse{n.CacheControl.Negative()}, nil
 		} else {
 			slog.Error("Couldn't open file", "file", filename, "error", err)
 			return api.GetNarInfo500Response{}, nil
 		}
 	}
-	n.limit.Acquire(ctx, 1)
+	err = n.limit.Acquire(ctx, 1)
+	if err != nil {
+		file.Close()
+		return api.GetNarInfo503Response{}, nil
+	}
 	defer n.limit.Release(1)
 
-	info, err := file.Stat()
+	response, err := newFileResponse(ctx, file, "text/x-nix-narinfo", n.CacheControl.NarInfo(), "")
 	if err != nil {
-		slog.Error("Couldn't get fileinfo", "file", filename, "error", err)
+		file.Close()
+		slog.Error("Couldn't serve file", "file", filename, "error", err)
 		return api.GetNarInfo500Response{}, nil
 	}
-
-	return api.GetNarInfo200TextxNixNarinfoResponse{
-		Body:          file,
-		ContentLength: info.Size(),
-	}, nil
+	return response, nil
 }
 
 // Check if a particular path exists quickly
@@ -289,9 +1228,22 @@ func (n NixStored) DoesNarInfoExist(ctx context.Context, request api.DoesNarInfo
 	filename := fmt.Sprintf("%s/%s.narinfo", n.StorePath, request.StorePathHash)
 
 	_, err := os.Stat(filename)
+	if os.IsNotExist(err) && n.local != nil {
+		info, err := n.local.NarInfo(request.StorePathHash)
+		if err != nil {
+			slog.Error("Couldn't query the local store", "storepathhash", request.StorePathHash, "error", err)
+			return api.DoesNarInfoExist500Response{}, nil
+		}
+		if info != nil {
+			return api.DoesNarInfoExist200Response{}, nil
+		}
+	}
+	if os.IsNotExist(err) && n.proxy.HasUpstreams() {
+		_, err = n.proxy.FetchNarInfo(request.StorePathHash)
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
-			return api.DoesNarInfoExist404Response{}, nil
+			return notFoundResponse{n.CacheControl.Negative()}, nil
 		} else {
 			slog.Error("Couldn't open file", "file", filename, "error", err)
 			return api.DoesNarInfoExist500Response{}, nil
@@ -304,23 +1256,184 @@ func (n NixStored) DoesNarInfoExist(ctx context.Context, request api.DoesNarInfo
 func (n NixStored) PutStorePathHashNarinfo(ctx context.Context, request api.PutStorePathHashNarinfoRequestObject) (api.PutStorePathHashNarinfoResponseObject, error) {
 	filename := fmt.Sprintf("%s/%s.narinfo", n.StorePath, request.StorePathHash)
 
-	file, err := os.Create(filename)
+	data, err := io.ReadAll(io.LimitReader(request.Body, 1<<20))
 	if err != nil {
-		slog.Error("Couldn't open file", "file", filename, "error", err)
+		slog.Error("Couldn't read narinfo", "error", err)
 		return api.PutStorePathHashNarinfo500Response{}, nil
 	}
-	defer file.Close()
-	n.limit.Acquire(ctx, 1)
+	// an invalid narinfo would break replication and recompression of the path
+	_, err = ParseNarInfo(bytes.NewReader(data))
+	if err != nil {
+		slog.Warn("Rejected narinfo", "storepathhash", request.StorePathHash, "error", err)
+		return api.PutStorePathHashNarinfo400Response{}, nil
+	}
+
+	err = n.limit.Acquire(ctx, 1)
+	if err != nil {
+		return api.PutStorePathHashNarinfo503Response{}, nil
+	}
 	defer n.limit.Release(1)
-	_, err = io.Copy(file, request.Body)
+	err = StoreNarInfo(filename, data)
 	if err != nil {
 		slog.Error("Couln't serve request", "error", err)
 		return api.PutStorePathHashNarinfo500Response{}, nil
 	}
 
+	if n.recompress != nil {
+		select {
+		case n.recompress <- request.StorePathHash + ".narinfo":
+		default:
+			slog.Warn("Recompression queue is full", "storepathhash", request.StorePathHash)
+		}
+	}
+	for _, r := range n.replicators {
+		r.Enqueue(request.StorePathHash)
+	}
 	return api.PutStorePathHashNarinfo201Response{}, nil
 }
 
+// Get the realisation of a derivation output
+// (GET /realisations/{drvOutput}.doi)
+func (n NixStored) GetRealisation(ctx context.Context, request api.GetRealisationRequestObject) (api.GetRealisationResponseObject, error) {
+	if !ValidDrvOutput(request.DrvOutput) {
+		return api.GetRealisation404Response{}, nil
+	}
+	filename := fmt.Sprintf("%s/realisations/%s.doi", n.StorePath, request.DrvOutput)
+
+	err := n.limit.Acquire(ctx, 1)
+	if err != nil {
+		return api.GetRealisation503Response{}, nil
+	}
+	defer n.limit.Release(1)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return api.GetRealisation404Response{}, nil
+		} else {
+			slog.Error("Couldn't open file", "file", filename, "error", err)
+			return api.GetRealisation500Response{}, nil
+		}
+	}
+
+	var realisation api.Realisation
+	err = json.Unmarshal(data, &realisation)
+	if err != nil {
+		slog.Error("Stored realisation is invalid", "file", filename, "error", err)
+		return api.GetRealisation500Response{}, nil
+	}
+
+	return api.GetRealisation200JSONResponse(realisation), nil
+}
+
+// Check if a realisation exists
+// (HEAD /realisations/{drvOutput}.doi)
+func (n NixStored) DoesRealisationExist(ctx context.Context, request api.DoesRealisationExistRequestObject) (api.DoesRealisationExistResponseObject, error) {
+	if !ValidDrvOutput(request.DrvOutput) {
+		return api.DoesRealisationExist404Response{}, nil
+	}
+	filename := fmt.Sprintf("%s/realisations/%s.doi", n.StorePath, request.DrvOutput)
+
+	_, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return api.DoesRealisationExist404Response{}, nil
+		} else {
+			slog.Error("Couldn't open file", "file", filename, "error", err)
+			return api.DoesRealisationExist500Response{}, nil
+		}
+	}
+	return api.DoesRealisationExist200Response{}, nil
+}
+
+// Upload the realisation of a derivation output
+// (PUT /realisations/{drvOutput}.doi)
+func (n NixStored) PutRealisation(ctx context.Context, request api.PutRealisationRequestObject) (api.PutRealisationResponseObject, error) {
+	err := ValidateRealisation(*request.Body, request.DrvOutput, n.TrustedKeys)
+	if err != nil {
+		slog.Warn("Rejected realisation", "id", request.DrvOutput, "error", err)
+		return api.PutRealisation400Response{}, nil
+	}
+	filename := fmt.Sprintf("%s/realisations/%s.doi", n.StorePath, request.DrvOutput)
+
+	data, err := json.Marshal(request.Body)
+	if err != nil {
+		slog.Error("Couldn't encode realisation", "id", request.DrvOutput, "error", err)
+		return api.PutRealisation500Response{}, nil
+	}
+
+	err = n.limit.Acquire(ctx, 1)
+	if err != nil {
+		return api.PutRealisation503Response{}, nil
+	}
+	defer n.limit.Release(1)
+	err = os.WriteFile(filename, data, 0660)
+	if err != nil {
+		slog.Error("Couldn't write file", "file", filename, "error", err)
+		return api.PutRealisation500Response{}, nil
+	}
+
+	return api.PutRealisation201Response{}, nil
+}
+
+// Get the NAR member containing the debug info for a build id
+// (GET /debuginfo/{buildId})
+func (n NixStored) GetDebugInfo(ctx context.Context, request api.GetDebugInfoRequestObject) (api.GetDebugInfoResponseObject, error) {
+	if !ValidBuildID(request.BuildId) {
+		return api.GetDebugInfo404Response{}, nil
+	}
+	redirect, err := ReadDebugInfoRedirect(n.StorePath+"/debuginfo", request.BuildId)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return api.GetDebugInfo404Response{}, nil
+		} else {
+			slog.Error("Couldn't read debuginfo redirect", "buildid", request.BuildId, "error", err)
+			return api.GetDebugInfo500Response{}, nil
+		}
+	}
+	return api.GetDebugInfo200JSONResponse(redirect), nil
+}
+
+// Check if a debug info redirect exists
+// (HEAD /debuginfo/{buildId})
+func (n NixStored) DoesDebugInfoExist(ctx context.Context, request api.DoesDebugInfoExistRequestObject) (api.DoesDebugInfoExistResponseObject, error) {
+	if !ValidBuildID(request.BuildId) {
+		return api.DoesDebugInfoExist404Response{}, nil
+	}
+	filename := fmt.Sprintf("%s/debuginfo/%s", n.StorePath, request.BuildId)
+
+	_, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return api.DoesDebugInfoExist404Response{}, nil
+		} else {
+			slog.Error("Couldn't open file", "file", filename, "error", err)
+			return api.DoesDebugInfoExist500Response{}, nil
+		}
+	}
+	return api.DoesDebugInfoExist200Response{}, nil
+}
+
+// Upload a debug info redirect, as written by nix with index-debug-info=true
+// (PUT /debuginfo/{buildId})
+func (n NixStored) PutDebugInfo(ctx context.Context, request api.PutDebugInfoRequestObject) (api.PutDebugInfoResponseObject, error) {
+	if !ValidBuildID(request.BuildId) {
+		slog.Warn("Rejected debuginfo redirect with invalid build id", "buildid", request.BuildId)
+		return api.PutDebugInfo400Response{}, nil
+	}
+	_, err := ParseDebugInfoRedirect(*request.Body)
+	if err != nil {
+		slog.Warn("Rejected debuginfo redirect", "buildid", request.BuildId, "error", err)
+		return api.PutDebugInfo400Response{}, nil
+	}
+
+	err = writeDebugInfoRedirect(n.StorePath+"/debuginfo", request.BuildId, *request.Body)
+	if err != nil {
+		slog.Error("Couldn't write debuginfo redirect", "buildid", request.BuildId, "error", err)
+		return api.PutDebugInfo500Response{}, nil
+	}
+	return api.PutDebugInfo201Response{}, nil
+}
+
 func LogMiddleware() api.StrictMiddlewareFunc {
 	return func(f nethttp.StrictHTTPHandlerFunc, operationID string) nethttp.StrictHTTPHandlerFunc {
 		return func(ctx context.Context, w http.ResponseWriter, r *http.Request, request interface{}) (response interface{}, err error) {
@@ -330,37 +1443,149 @@ func LogMiddleware() api.StrictMiddlewareFunc {
 	}
 }
 
-func BasicAuthMiddleware(ruser Authentication, rwUser Authentication) api.StrictMiddlewareFunc {
+// Auth are the users of a cache, the read and write user of the settings
+// and the users of the user file, the API tokens, the OIDC issuers and the
+// rules for client certificates.
+type Auth struct {
+	Read        Authentication
+	Write       Authentication
+	Users       *UserDB
+	Tokens      *TokenStore
+	OIDC        *OIDC
+	ClientCerts *ClientCertRules
+	// Cache and StorePath are checked against the limits of tokens
+	Cache     string
+	StorePath string
+}
+
+func (cs CacheSettings) Auth() Auth {
+	return Auth{Read: cs.UserRead, Write: cs.UserWrite, Users: cs.Users, Tokens: cs.Tokens, OIDC: cs.OIDC, ClientCerts: cs.ClientCerts, Cache: cs.Name, StorePath: cs.StorePath}
+}
+
+func (a Auth) enabled() bool {
+	return a.Read.User != "" || a.Write.User != "" || a.Users != nil || a.OIDC != nil || a.ClientCerts != nil
+}
+
+// credentialsMatch compares credentials in constant time.
+func credentialsMatch(user string, pass string, auth Authentication) bool {
+	if auth.User == "" {
+		return false
+	}
+	userSum, authUserSum := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(auth.User))
+	passSum, authPassSum := sha256.Sum256([]byte(pass)), sha256.Sum256([]byte(auth.Pass))
+	return subtle.ConstantTimeCompare(userSum[:], authUserSum[:])&subtle.ConstantTimeCompare(passSum[:], authPassSum[:]) == 1
+}
+
+// checkAuth checks the credentials of a request. Tokens and OIDC ID tokens
+// are accepted as bearer token and as basic auth password with any user,
+// for netrc. The write user of the settings is an admin, the read user may
+// only read. It returns the token if one was used, ID tokens are returned
+// as token with the permissions of their rule. A verified client
+// certificate with a role is used instead of any credentials.
+func (a Auth) checkAuth(r *http.Request, need api.TokenScope) (*Token, error) {
+	if a.ClientCerts != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		role, ok := a.ClientCerts.Role(cert)
+		if ok {
+			if !role.grants(need) {
+				return nil, fmt.Errorf("Certificate %s may not %s as %s", cert.Subject, need, role)
+			}
+			return nil, nil
+		}
+	}
+
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			return nil, fmt.Errorf("Corrupt BasicAuth")
+		}
+		if !strings.HasPrefix(pass, tokenPrefix) && !(a.OIDC != nil && looksLikeJWT(pass)) {
+			return nil, a.checkBasicAuth(user, pass, need)
+		}
+		secret = pass
+	}
+	secret = strings.TrimSpace(secret)
+
+	var token *Token
+	var err error
+	switch {
+	case strings.HasPrefix(secret, tokenPrefix) && a.Tokens != nil:
+		token, err = a.Tokens.Verify(secret)
+	case a.OIDC != nil:
+		token, err = a.OIDC.Authenticate(r.Context(), secret)
+	default:
+		err = ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, token.allows(need, a.Cache)
+}
+
+func (a Auth) checkBasicAuth(user string, pass string, need api.TokenScope) error {
+	role := Role(0)
+	if a.Users != nil {
+		role, _ = a.Users.Authenticate(user, pass)
+	}
+	if role == 0 && credentialsMatch(user, pass, a.Write) {
+		role = RoleAdmin
+	}
+	if role == 0 && credentialsMatch(user, pass, a.Read) {
+		role = RoleRead
+	}
+	if role == 0 {
+		return fmt.Errorf("Wrong Credentials")
+	}
+	if !role.grants(need) {
+		return fmt.Errorf("User %s may not %s as %s", user, need, role)
+	}
+	return nil
+}
+
+type tokenKey struct{}
+
+// BasicAuthMiddleware authenticates requests. The token a request was
+// authenticated with, if any, is available via the context.
+func BasicAuthMiddleware(auth Auth) api.StrictMiddlewareFunc {
 	return func(f nethttp.StrictHTTPHandlerFunc, operationID string) nethttp.StrictHTTPHandlerFunc {
 		// nothing needs to be authenticated on auth none
-		if ruser.User == "" && rwUser.User == "" {
+		if !auth.enabled() {
 			return f
 		}
 
-		switch operationID {
-		case "PutNarFileHashNarCompression":
-		case "PutStorePathHashNarinfo":
-			return func(ctx context.Context, w http.ResponseWriter, r *http.Request, request interface{}) (response interface{}, err error) {
-				user, pass, ok := r.BasicAuth()
-				if !ok {
-					return nil, fmt.Errorf("Corrupt BasicAuth")
-				}
-				if user != rwUser.User || pass != rwUser.Pass {
-					return nil, fmt.Errorf("Wrong Credentials")
-				}
-				return f(ctx, w, r, request)
-			}
-		}
-
+		need := operationScope(operationID)
 		return func(ctx context.Context, w http.ResponseWriter, r *http.Request, request interface{}) (response interface{}, err error) {
-			user, pass, ok := r.BasicAuth()
-			if !ok {
-				return nil, fmt.Errorf("Corrupt BasicAuth")
+			token, err := auth.checkAuth(r, need)
+			if err != nil {
+				return nil, err
 			}
-			if (user == ruser.User && pass == ruser.Pass) || (user == rwUser.User && pass == rwUser.Pass) {
-				return f(ctx, w, r, request)
+			if token != nil {
+				request, err = token.checkName(operationID, request, auth.StorePath)
+				if err != nil {
+					return nil, err
+				}
+				ctx = context.WithValue(ctx, tokenKey{}, token)
 			}
-			return nil, fmt.Errorf("Wrong Credentials")
+			return f(ctx, w, r, request)
 		}
 	}
 }
+
+// BasicAuthHandler protects endpoints that aren't part of the api, they
+// need read access.
+func BasicAuthHandler(next http.Handler, auth Auth) http.Handler {
+	if !auth.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := auth.checkAuth(r, api.Read)
+		if err != nil {
+			slog.Warn("Request Error", "error", err)
+			w.Header().Set("WWW-Authenticate", `Basic realm="nix-stored"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
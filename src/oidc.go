@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+// ErrInvalidJWT is returned for ID tokens that can't be verified or that
+// no rule grants anything.
+var ErrInvalidJWT = errors.New("Invalid ID token")
+
+// jwtLeeway is the clock skew allowed for exp, nbf and iat
+const jwtLeeway = time.Minute
+
+// jwksMaxAge is how long fetched JWKS are used before they are fetched
+// again. Unknown key ids fetch them again earlier, at most every
+// jwksMinAge.
+const (
+	jwksMaxAge = time.Hour
+	jwksMinAge = time.Minute
+)
+
+// oidcFile is the content of an OIDC file.
+type oidcFile struct {
+	Issuers []*oidcIssuer `json:"issuers"`
+}
+
+// oidcIssuer is an identity provider like GitHub Actions and the rules
+// mapping the claims of its ID tokens to permissions. JWKS is a url or a
+// local file, it's discovered through the issuer if empty.
+type oidcIssuer struct {
+	Issuer   string     `json:"issuer"`
+	Audience string     `json:"audience"`
+	JWKS     string     `json:"jwks"`
+	Rules    []oidcRule `json:"rules"`
+
+	keys jwks
+}
+
+// oidcRule grants scopes to ID tokens whose claims all match the glob
+// patterns of Claims, optionally limited to a cache and a name pattern
+// like tokens.
+type oidcRule struct {
+	Claims map[string]string `json:"claims"`
+	Scopes []api.TokenScope  `json:"scopes"`
+	Cache  string            `json:"cache"`
+	Name   string            `json:"name"`
+}
+
+// jwks are the keys of an issuer, fetched on demand. Concurrent fetches
+// are only done once.
+type jwks struct {
+	fetches singleflight.Group
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// OIDC verifies ID tokens of CI jobs against the issuers of an OIDC file.
+// The file is read again on Reload.
+type OIDC struct {
+	file    string
+	issuers atomic.Pointer[[]*oidcIssuer]
+	client  *http.Client
+}
+
+func LoadOIDC(file string) (*OIDC, error) {
+	o := &OIDC{file: file, client: &http.Client{Timeout: 10 * time.Second}}
+	err := o.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *OIDC) String() string {
+	return o.file
+}
+
+// Reload reads the OIDC file again. The old issuers stay if it's invalid.
+// JWKS of local files are read right away, urls are fetched when needed.
+func (o *OIDC) Reload() error {
+	data, err := os.ReadFile(o.file)
+	if err != nil {
+		return err
+	}
+	var config oidcFile
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return fmt.Errorf("Invalid OIDC file %s: %w", o.file, err)
+	}
+	seen := map[string]bool{}
+	for _, issuer := range config.Issuers {
+		if !strings.HasPrefix(issuer.Issuer, "https://") && !strings.HasPrefix(issuer.Issuer, "http://") {
+			return fmt.Errorf("Invalid issuer %q, must be an http or https url", issuer.Issuer)
+		}
+		if seen[issuer.Issuer] {
+			return fmt.Errorf("Duplicate issuer %s", issuer.Issuer)
+		}
+		seen[issuer.Issuer] = true
+		if issuer.Audience == "" {
+			return fmt.Errorf("Issuer %s has no audience", issuer.Issuer)
+		}
+		for i, rule := range issuer.Rules {
+			err = rule.validate()
+			if err != nil {
+				return fmt.Errorf("Rule %d of %s: %w", i+1, issuer.Issuer, err)
+			}
+		}
+		if issuer.JWKS != "" && !strings.Contains(issuer.JWKS, "://") {
+			data, err := os.ReadFile(issuer.JWKS)
+			if err != nil {
+				return fmt.Errorf("Couldn't read JWKS of %s: %w", issuer.Issuer, err)
+			}
+			issuer.keys.keys, err = parseJWKS(data)
+			if err != nil {
+				return fmt.Errorf("Invalid JWKS of %s: %w", issuer.Issuer, err)
+			}
+		}
+	}
+	o.issuers.Store(&config.Issuers)
+	return nil
+}
+
+func (r oidcRule) validate() error {
+	if len(r.Claims) == 0 {
+		return fmt.Errorf("A rule needs at least one claim")
+	}
+	for claim, pattern := range r.Claims {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("Invalid pattern %q of claim %s: %w", pattern, claim, err)
+		}
+	}
+	if len(r.Scopes) == 0 {
+		return fmt.Errorf("A rule needs at least one scope")
+	}
+	for _, scope := range r.Scopes {
+		if !validTokenScope(scope) {
+			return fmt.Errorf("Unknown scope %q, must be read, write, delete or admin", scope)
+		}
+	}
+	if r.Cache != "" && !cacheNameRegex.MatchString(r.Cache) {
+		return fmt.Errorf("Invalid cache name %q", r.Cache)
+	}
+	if r.Name != "" {
+		_, err := path.Match(r.Name, "")
+		if err != nil {
+			return fmt.Errorf("Invalid name pattern %q: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// looksLikeJWT reports whether a credential is a JWT rather than a
+// password.
+func looksLikeJWT(s string) bool {
+	return strings.HasPrefix(s, "eyJ") && strings.Count(s, ".") == 2
+}
+
+// Authenticate verifies an ID token and returns what the first matching
+// rule of its issuer grants, as token.
+func (o *OIDC) Authenticate(ctx context.Context, jwt string) (*Token, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", ErrInvalidJWT)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid header: %w", ErrInvalidJWT, err)
+	}
+	claims := map[string]any{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid claims: %w", ErrInvalidJWT, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature: %w", ErrInvalidJWT, err)
+	}
+
+	iss, _ := claims["iss"].(string)
+	var issuer *oidcIssuer
+	for _, i := range *o.issuers.Load() {
+		if i.Issuer == iss {
+			issuer = i
+		}
+	}
+	if issuer == nil {
+		return nil, fmt.Errorf("%w: unknown issuer %q", ErrInvalidJWT, iss)
+	}
+	key, err := o.key(ctx, issuer, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidJWT, err)
+	}
+	err = checkJWTClaims(claims, issuer.Audience, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidJWT, err)
+	}
+
+	sub, _ := claims["sub"].(string)
+	for _, rule := range issuer.Rules {
+		if !rule.matches(claims) {
+			continue
+		}
+		exp, _ := claims["exp"].(float64)
+		token := &Token{TokenInfo: api.TokenInfo{Id: "oidc:" + sub, Scopes: rule.Scopes, Expires: time.Unix(int64(exp), 0)}}
+		if rule.Cache != "" {
+			token.Cache = &rule.Cache
+		}
+		if rule.Name != "" {
+			token.Name = &rule.Name
+		}
+		return token, nil
+	}
+	return nil, fmt.Errorf("%w: no rule matches %s of %s", ErrInvalidJWT, sub, iss)
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// checkJWTClaims checks the audience and the validity period of an ID
+// token. exp is required.
+func checkJWTClaims(claims map[string]any, audience string, now time.Time) error {
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud != audience {
+			return fmt.Errorf("it's for %q, not %q", aud, audience)
+		}
+	case []any:
+		found := false
+		for _, a := range aud {
+			found = found || a == audience
+		}
+		if !found {
+			return fmt.Errorf("it's not for %q", audience)
+		}
+	default:
+		return fmt.Errorf("it has no audience")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("it has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return fmt.Errorf("it expired at %s", time.Unix(int64(exp), 0))
+	}
+	for _, claim := range []string{"nbf", "iat"} {
+		t, ok := claims[claim].(float64)
+		if ok && now.Add(jwtLeeway).Before(time.Unix(int64(t), 0)) {
+			return fmt.Errorf("it's not valid before %s", time.Unix(int64(t), 0))
+		}
+	}
+	return nil
+}
+
+// matches reports whether all claims of a rule match. Claims that aren't
+// strings are compared as JSON, so booleans and numbers work as well.
+func (r oidcRule) matches(claims map[string]any) bool {
+	for claim, pattern := range r.Claims {
+		value, ok := claims[claim]
+		if !ok {
+			return false
+		}
+		s, ok := value.(string)
+		if !ok {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return false
+			}
+			s = string(data)
+		}
+		match, _ := path.Match(pattern, s)
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the key of an issuer with a key id, fetching its JWKS if
+// they are old or don't have the key.
+func (o *OIDC) key(ctx context.Context, issuer *oidcIssuer, kid string) (crypto.PublicKey, error) {
+	k := &issuer.keys
+	local := issuer.JWKS != "" && !strings.Contains(issuer.JWKS, "://")
+	find := func() crypto.PublicKey {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if kid == "" && len(k.keys) == 1 {
+			for _, key := range k.keys {
+				return key
+			}
+		}
+		return k.keys[kid]
+	}
+
+	key := find()
+	k.mu.Lock()
+	age := time.Since(k.fetched)
+	k.mu.Unlock()
+	if !local && (age > jwksMaxAge || (key == nil && age > jwksMinAge)) {
+		// the lock isn't held while fetching, so a slow issuer doesn't
+		// block the keys that are known
+		_, err, _ := k.fetches.Do("", func() (interface{}, error) {
+			keys, err := o.fetchJWKS(context.WithoutCancel(ctx), issuer)
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			k.fetched = time.Now()
+			if err != nil {
+				return nil, err
+			}
+			k.keys = keys
+			return nil, nil
+		})
+		if err != nil {
+			slog.Warn("Couldn't fetch JWKS", "issuer", issuer.Issuer, "error", err)
+		}
+		key = find()
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: unknown key %q of %s", ErrInvalidJWT, kid, issuer.Issuer)
+	}
+	return key, nil
+}
+
+// fetchJWKS fetches the JWKS of an issuer, from the jwks_uri of its
+// discovery document if no url is configured.
+func (o *OIDC) fetchJWKS(ctx context.Context, issuer *oidcIssuer) (map[string]crypto.PublicKey, error) {
+	jwksURL := issuer.JWKS
+	if jwksURL == "" {
+		data, err := o.get(ctx, strings.TrimSuffix(issuer.Issuer, "/")+"/.well-known/openid-configuration")
+		if err != nil {
+			return nil, err
+		}
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		err = json.Unmarshal(data, &discovery)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid discovery document: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("Discovery document has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	data, err := o.get(ctx, jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+func (o *OIDC) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s of %s", resp.Status, u)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// parseJWKS parses the RSA, EC and Ed25519 signing keys of a JWKS. Other
+// keys are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch jwk.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("Invalid RSA key %q", jwk.Kid)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("Invalid EC key %q", jwk.Kid)
+			}
+			ec := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(ec.X, ec.Y) {
+				return nil, fmt.Errorf("Invalid EC key %q", jwk.Kid)
+			}
+			key = ec
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if jwk.Crv != "Ed25519" {
+				continue
+			}
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("Invalid Ed25519 key %q", jwk.Kid)
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// verifyJWTSignature checks the signature of a JWT. The algorithm has to
+// fit the key, so a token can't choose a weaker one.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(signed)
+		digest = sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(signed)
+		digest = sum[:]
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(key, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || key.Curve.Params().BitSize != hash.Size()*8 {
+			break
+		}
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(key, signed, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %s doesn't fit the key", alg)
+}
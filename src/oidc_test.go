@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+const (
+	testIssuer   = "https://token.actions.githubusercontent.com"
+	testAudience = "https://cache.example.com"
+)
+
+// testIssuerKeys are the private keys of the test issuer, by key id.
+type testIssuerKeys map[string]crypto.Signer
+
+// testOIDC writes the public keys of a RSA, an EC and an Ed25519 key to a
+// local JWKS file and loads an OIDC file using it.
+func testOIDC(t *testing.T) (*OIDC, testIssuerKeys) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+	}}
+	dir := t.TempDir()
+	writeJSON(t, dir+"/jwks.json", jwks)
+	writeJSON(t, dir+"/oidc.json", map[string]any{"issuers": []map[string]any{{
+		"issuer":   testIssuer,
+		"audience": testAudience,
+		"jwks":     dir + "/jwks.json",
+		"rules": []map[string]any{
+			{"claims": map[string]string{"repository": "myorg/*", "ref": "refs/heads/main"}, "scopes": []string{"read", "write"}, "name": "myproj-*"},
+			{"claims": map[string]string{"repository": "myorg/*"}, "scopes": []string{"read"}},
+		},
+	}}})
+	o, err := LoadOIDC(dir + "/oidc.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, testIssuerKeys{"rsa": rsaKey, "ec": ecKey, "ed": edKey}
+}
+
+func writeJSON(t *testing.T, file string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(file, data, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sign returns a JWT of claims signed with the key kid, claiming alg in
+// its header.
+func (k testIssuerKeys) sign(t *testing.T, alg string, kid string, claims map[string]any) string {
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	sum := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch key := k[kid].(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, sum[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testClaims(modify func(claims map[string]any)) map[string]any {
+	claims := map[string]any{
+		"iss":        testIssuer,
+		"aud":        testAudience,
+		"sub":        "repo:myorg/myproj:ref:refs/heads/main",
+		"repository": "myorg/myproj",
+		"ref":        "refs/heads/main",
+		"iat":        float64(time.Now().Unix()),
+		"exp":        float64(time.Now().Add(5 * time.Minute).Unix()),
+	}
+	if modify != nil {
+		modify(claims)
+	}
+	return claims
+}
+
+func TestOIDCKeys(t *testing.T) {
+	o, keys := testOIDC(t)
+	for kid, alg := range map[string]string{"rsa": "RS256", "ec": "ES256", "ed": "EdDSA"} {
+		t.Run(kid, func(t *testing.T) {
+			claims := testClaims(nil)
+			token, err := o.Authenticate(context.Background(), keys.sign(t, alg, kid, claims))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Id != "oidc:repo:myorg/myproj:ref:refs/heads/main" || !slices.Equal(token.Scopes, []api.TokenScope{api.Read, api.Write}) {
+				t.Errorf("got %+v", token.TokenInfo)
+			}
+			if !token.Expires.Equal(time.Unix(int64(claims["exp"].(float64)), 0)) {
+				t.Errorf("token expires at %s, not at exp", token.Expires)
+			}
+		})
+	}
+}
+
+func TestOIDCAlgorithmMismatch(t *testing.T) {
+	o, keys := testOIDC(t)
+	tests := map[string]struct{ alg, kid string }{
+		"RS256 with EC key":     {"RS256", "ec"},
+		"ES256 with RSA key":    {"ES256", "rsa"},
+		"EdDSA with RSA key":    {"EdDSA", "rsa"},
+		"PS256 with RS256 sig":  {"PS256", "rsa"},
+		"ES384 with P-256 key":  {"ES384", "ec"},
+		"HS256 with RSA key":    {"HS256", "rsa"},
+		"none with Ed25519 key": {"none", "ed"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := o.Authenticate(context.Background(), keys.sign(t, test.alg, test.kid, testClaims(nil)))
+			if !errors.Is(err, ErrInvalidJWT) {
+				t.Errorf("got %v, want an invalid ID token", err)
+			}
+		})
+	}
+}
+
+func TestOIDCClaims(t *testing.T) {
+	o, keys := testOIDC(t)
+	tests := map[string]func(claims map[string]any){
+		"wrong issuer":      func(claims map[string]any) { claims["iss"] = "https://gitlab.com" },
+		"wrong audience":    func(claims map[string]any) { claims["aud"] = "https://other.example.com" },
+		"wrong audiences":   func(claims map[string]any) { claims["aud"] = []any{"https://other.example.com"} },
+		"no audience":       func(claims map[string]any) { delete(claims, "aud") },
+		"expired":           func(claims map[string]any) { claims["exp"] = float64(time.Now().Add(-2 * jwtLeeway).Unix()) },
+		"no expiry":         func(claims map[string]any) { delete(claims, "exp") },
+		"not yet valid":     func(claims map[string]any) { claims["nbf"] = float64(time.Now().Add(2 * jwtLeeway).Unix()) },
+		"no matching rule":  func(claims map[string]any) { claims["repository"] = "otherorg/myproj" },
+		"non string claims": func(claims map[string]any) { claims["repository"] = 42 },
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := o.Authenticate(context.Background(), keys.sign(t, "ES256", "ec", testClaims(modify)))
+			if !errors.Is(err, ErrInvalidJWT) {
+				t.Errorf("got %v, want an invalid ID token", err)
+			}
+		})
+	}
+
+	// a listed audience and an expiry within the leeway are fine
+	token := keys.sign(t, "ES256", "ec", testClaims(func(claims map[string]any) {
+		claims["aud"] = []any{"https://other.example.com", testAudience}
+		claims["exp"] = float64(time.Now().Add(-jwtLeeway / 2).Unix())
+	}))
+	_, err := o.Authenticate(context.Background(), token)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCRules(t *testing.T) {
+	o, keys := testOIDC(t)
+
+	token, err := o.Authenticate(context.Background(), keys.sign(t, "EdDSA", "ed", testClaims(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Name == nil || *token.Name != "myproj-*" || token.Cache != nil {
+		t.Errorf("first rule didn't limit the name: %+v", token.TokenInfo)
+	}
+
+	// other branches only match the second rule
+	token, err = o.Authenticate(context.Background(), keys.sign(t, "EdDSA", "ed", testClaims(func(claims map[string]any) {
+		claims["ref"] = "refs/heads/feature"
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(token.Scopes, []api.TokenScope{api.Read}) || token.Name != nil {
+		t.Errorf("got %+v, want the second rule", token.TokenInfo)
+	}
+
+	// a rule needs all its claims
+	token, err = o.Authenticate(context.Background(), keys.sign(t, "EdDSA", "ed", testClaims(func(claims map[string]any) {
+		delete(claims, "ref")
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(token.Scopes, []api.TokenScope{api.Read}) {
+		t.Errorf("got %+v, want the second rule", token.TokenInfo)
+	}
+}
+
+func TestOIDCRuleMatchesJSON(t *testing.T) {
+	rule := oidcRule{Claims: map[string]string{"runner_environment": "github-hosted", "run_attempt": "1", "protected": "true"}}
+	claims := map[string]any{"runner_environment": "github-hosted", "run_attempt": float64(1), "protected": true}
+	if !rule.matches(claims) {
+		t.Error("rule doesn't match numbers and booleans")
+	}
+	claims["protected"] = false
+	if rule.matches(claims) {
+		t.Error("rule matches a false claim")
+	}
+}
+
+func TestOIDCFetchDoesntBlock(t *testing.T) {
+	o, keys := testOIDC(t)
+	issuer := (*o.issuers.Load())[0]
+	data, err := os.ReadFile(issuer.JWKS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetching := make(chan struct{}, 1)
+	release := make(chan struct{})
+	block := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if block {
+			fetching <- struct{}{}
+			<-release
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+	defer close(release)
+	issuer.JWKS = server.URL
+
+	_, err = o.Authenticate(context.Background(), keys.sign(t, "ES256", "ec", testClaims(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unknown key makes it fetch the JWKS again, which hangs
+	block = true
+	issuer.keys.mu.Lock()
+	issuer.keys.fetched = time.Now().Add(-2 * jwksMinAge)
+	issuer.keys.mu.Unlock()
+	go o.Authenticate(context.Background(), keys.sign(t, "ES256", "other", testClaims(nil)))
+	<-fetching
+
+	token := keys.sign(t, "RS256", "rsa", testClaims(nil))
+	done := make(chan error)
+	go func() {
+		_, err := o.Authenticate(context.Background(), token)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("a known key waited for the JWKS fetch")
+	}
+}
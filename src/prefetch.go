@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+// PrefetchJob fetches the closures of store paths from the upstreams of a
+// cache in the background.
+type PrefetchJob struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	status   api.PrefetchStatus
+	finished time.Time
+}
+
+// StartPrefetch starts fetching the closures of storePaths from the
+// upstreams of proxy with w. fetched is called for every fetched path.
+func StartPrefetch(w *workers, proxy *Proxy, storePaths []string, fetched func(storePath string)) (*PrefetchJob, error) {
+	if !proxy.HasUpstreams() {
+		return nil, errors.New("The cache has no upstreams to prefetch from")
+	}
+	if len(storePaths) == 0 {
+		return nil, errors.New("No store paths to prefetch")
+	}
+	opts := SyncOptions{Pull: true, Roots: storePaths}
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(w.ctx)
+	j := &PrefetchJob{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		status: api.PrefetchStatus{
+			Id:     id,
+			State:  api.PrefetchStatusStateResolving,
+			Paths:  slices.Clone(storePaths),
+			Failed: []string{},
+		},
+	}
+	s := &syncer{
+		opts:      opts,
+		local:     proxy.storePath,
+		proxy:     proxy,
+		upstreams: proxy.upstreams,
+		copied: func(storePath string, err error) {
+			j.mu.Lock()
+			defer j.mu.Unlock()
+			if err != nil {
+				j.status.Failed = append(j.status.Failed, storePath)
+				return
+			}
+			j.status.Fetched++
+			if fetched != nil {
+				fetched(storePath)
+			}
+		},
+	}
+	w.Go(func(context.Context) { j.run(ctx, s) })
+	return j, nil
+}
+
+func (j *PrefetchJob) run(ctx context.Context, s *syncer) {
+	defer close(j.done)
+	defer j.cancel()
+
+	roots := make([]string, len(s.opts.Roots))
+	for i, root := range s.opts.Roots {
+		roots[i], _, _ = strings.Cut(path.Base(root), "-")
+	}
+	paths, broken, err := s.plan(ctx, roots, s.lookupRemote, s.localHas)
+	if err == nil {
+		j.mu.Lock()
+		j.status.State = api.PrefetchStatusStateFetching
+		j.status.Total = len(paths)
+		j.mu.Unlock()
+		slog.Info("Prefetching", "id", j.status.Id, "paths", len(paths))
+
+		var pulled, failed []string
+		s.copyPaths(ctx, paths, broken, &pulled, &failed, func(p syncPath) error {
+			return s.proxy.pull(ctx, p.hash, p.info, p.narURL)
+		})
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	switch {
+	case ctx.Err() != nil:
+		j.status.State = api.PrefetchStatusStateCanceled
+	case err != nil:
+		j.status.State = api.PrefetchStatusStateFailed
+		message := err.Error()
+		j.status.Error = &message
+	default:
+		j.status.State = api.PrefetchStatusStateDone
+	}
+	slog.Info("Prefetch finished", "id", j.status.Id, "state", j.status.State, "fetched", j.status.Fetched, "failed", len(j.status.Failed))
+}
+
+// Status returns the progress of the prefetch.
+func (j *PrefetchJob) Status() api.PrefetchStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.Failed = slices.Clone(j.status.Failed)
+	return status
+}
+
+// Cancel stops the prefetch. A NAR that is being downloaded is still
+// finished, other clients may be waiting for it.
+func (j *PrefetchJob) Cancel() {
+	j.cancel()
+}
+
+func (j *PrefetchJob) finishedAt() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finished
+}
+
+// Done is closed when the prefetch finished.
+func (j *PrefetchJob) Done() <-chan struct{} {
+	return j.done
+}
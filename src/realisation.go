@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+var (
+	drvOutputRegex     = regexp.MustCompile(`^sha256:[0-9a-f]{64}![A-Za-z0-9+\-._?=]+$`)
+	storePathBaseRegex = regexp.MustCompile(`^[0-9a-df-np-sv-z]{32}-[A-Za-z0-9+\-._?=]+$`)
+)
+
+// ValidDrvOutput reports whether id is a derivation output id like
+// sha256:<base16 hash>!out.
+func ValidDrvOutput(id string) bool {
+	return drvOutputRegex.MatchString(id)
+}
+
+// RealisationFingerprint returns the data nix signs for a realisation. It's
+// the realisation's JSON without signatures, with sorted keys.
+func RealisationFingerprint(r api.Realisation) (string, error) {
+	deps := map[string]string{}
+	if r.DependentRealisations != nil {
+		deps = *r.DependentRealisations
+	}
+	fingerprint := struct {
+		DependentRealisations map[string]string `json:"dependentRealisations"`
+		Id                    string            `json:"id"`
+		OutPath               string            `json:"outPath"`
+	}{deps, r.Id, r.OutPath}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(fingerprint)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// ValidateRealisation checks the structure of a realisation uploaded for
+// drvOutput. If trusted keys are given, one of its signatures has to be made
+// by one of them.
+func ValidateRealisation(r api.Realisation, drvOutput string, trusted PublicKeys) error {
+	if !ValidDrvOutput(drvOutput) || r.Id != drvOutput {
+		return fmt.Errorf("Realisation id %q doesn't match %q", r.Id, drvOutput)
+	}
+	if !storePathBaseRegex.MatchString(r.OutPath) {
+		return fmt.Errorf("Invalid outPath %q", r.OutPath)
+	}
+	if r.DependentRealisations != nil {
+		for id, path := range *r.DependentRealisations {
+			if !ValidDrvOutput(id) || !storePathBaseRegex.MatchString(path) {
+				return fmt.Errorf("Invalid dependent realisation %q: %q", id, path)
+			}
+		}
+	}
+
+	if len(trusted) == 0 {
+		return nil
+	}
+	if r.Signatures == nil {
+		return fmt.Errorf("Realisation is not signed")
+	}
+	fingerprint, err := RealisationFingerprint(r)
+	if err != nil {
+		return err
+	}
+	if !trusted.VerifyAny(fingerprint, *r.Signatures) {
+		return fmt.Errorf("Realisation has no signature by a trusted key")
+	}
+	return nil
+}
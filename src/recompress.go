@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Recompression is the compression uploaded NARs are transcoded to. An empty
+// Compression disables recompression.
+type Recompression struct {
+	Compression string
+	Level       int
+}
+
+// default levels if none is given, the same as the command line tools
+var recompressionLevels = map[string]int{"zstd": 3, "xz": 6, "br": 11, "none": 0}
+
+// ParseRecompression parses a compression like zstd-19. The level is
+// optional.
+func ParseRecompression(s string) (Recompression, error) {
+	if s == "" {
+		return Recompression{}, nil
+	}
+	compression, levelStr, hasLevel := strings.Cut(s, "-")
+	level, ok := recompressionLevels[compression]
+	if !ok {
+		return Recompression{}, fmt.Errorf("Unsupported recompression %q", s)
+	}
+	if hasLevel {
+		var err error
+		level, err = strconv.Atoi(levelStr)
+		if err != nil {
+			return Recompression{}, fmt.Errorf("Invalid compression level %q", levelStr)
+		}
+	}
+
+	var min, max int
+	switch compression {
+	case "zstd":
+		min, max = 1, 22
+	case "xz":
+		min, max = 0, 9
+	case "br":
+		min, max = 0, 11
+	}
+	if level < min || level > max {
+		return Recompression{}, fmt.Errorf("Compression level of %s must be between %d and %d", compression, min, max)
+	}
+	return Recompression{Compression: compression, Level: level}, nil
+}
+
+func (c Recompression) String() string {
+	if c.Compression == "none" {
+		return c.Compression
+	}
+	return fmt.Sprintf("%s-%d", c.Compression, c.Level)
+}
+
+// narFileName returns the file name nix uses for a NAR with this
+// compression.
+func (c Recompression) narFileName(fileHash string) string {
+	switch c.Compression {
+	case "none":
+		return fileHash + ".nar"
+	case "zstd":
+		return fileHash + ".nar.zst"
+	default:
+		return fileHash + ".nar." + c.Compression
+	}
+}
+
+// xz dictionary sizes of the presets of the xz command line tool
+var xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+func (c Recompression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.Compression {
+	case "none":
+		return nopWriteCloser{w}, nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.Level)))
+	case "xz":
+		return xz.WriterConfig{DictCap: xzDictCaps[c.Level]}.NewWriter(w)
+	case "br":
+		return brotli.NewWriterLevel(w, c.Level), nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression: %s", c.Compression)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+const nixBase32Chars = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// nixBase32 encodes a hash the way nix does in narinfos and store paths.
+func nixBase32(hash []byte) string {
+	size := (len(hash)*8-1)/5 + 1
+	out := make([]byte, size)
+	for n := size - 1; n >= 0; n-- {
+		b := n * 5
+		i := b / 8
+		j := b % 8
+		c := hash[i] >> j
+		if i+1 < len(hash) {
+			c |= hash[i+1] << (8 - j)
+		}
+		out[size-1-n] = nixBase32Chars[c&0x1f]
+	}
+	return string(out)
+}
+
+// hashMatches reports whether a sha256 hash of a narinfo (sha256:<hash> in
+// nix base32 or base16) is sum.
+func hashMatches(narHash string, sum []byte) bool {
+	hash, ok := strings.CutPrefix(narHash, "sha256:")
+	if !ok {
+		return false
+	}
+	return hash == nixBase32(sum) || hash == hex.EncodeToString(sum)
+}
+
+// countingWriter counts and hashes everything written to it.
+type countingWriter struct {
+	hash hash.Hash
+	size uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.size += uint64(len(p))
+	return c.hash.Write(p)
+}
+
+// RecompressNar transcodes the NAR of a narinfo in the store to target and
+// rewrites the narinfo to point to it. The old NAR is removed unless other
+// narinfos still point to it. The uploaded NarHash is verified before
+// anything is replaced. It returns the file name of the new NAR, or an
+// empty string if the NAR already had the target compression.
+func RecompressNar(storePath string, narinfoFile string, target Recompression) (string, error) {
+	filename := storePath + "/" + narinfoFile
+	original, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	info, err := ParseNarInfo(bytes.NewReader(original))
+	if err != nil {
+		return "", err
+	}
+	if info.Compression == target.Compression {
+		return "", nil
+	}
+	dir, oldFile := path.Split(path.Clean(info.URL))
+	if dir != "nar/" {
+		return "", fmt.Errorf("NAR %q isn't stored in this cache", info.URL)
+	}
+
+	in, err := os.Open(storePath + "/nar/" + oldFile)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	r, err := decompressNar(in, info.Compression)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp(storePath+"/nar", ".recompress-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	compressed := &countingWriter{hash: sha256.New()}
+	w, err := target.newWriter(io.MultiWriter(tmp, compressed))
+	if err != nil {
+		return "", err
+	}
+	uncompressed := &countingWriter{hash: sha256.New()}
+	_, err = io.Copy(io.MultiWriter(w, uncompressed), r)
+	if err != nil {
+		return "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	if !hashMatches(info.NarHash, uncompressed.hash.Sum(nil)) || uncompressed.size != info.NarSize {
+		return "", fmt.Errorf("NAR %s doesn't match the NarHash of %s", oldFile, narinfoFile)
+	}
+
+	fileHash := nixBase32(compressed.hash.Sum(nil))
+	newFile := target.narFileName(fileHash)
+	err = os.Rename(tmp.Name(), storePath+"/nar/"+newFile)
+	if err != nil {
+		return "", err
+	}
+
+	// only these lines change, fields NarInfo doesn't know stay as they are
+	patched := patchNarInfo(original, [][2]string{
+		{"URL", "nar/" + newFile},
+		{"Compression", target.Compression},
+		{"FileHash", "sha256:" + fileHash},
+		{"FileSize", strconv.FormatUint(compressed.size, 10)},
+	})
+
+	// don't overwrite a narinfo that was uploaded again in the meantime
+	idx := narIndexOf(storePath)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	err = replaceNarInfo(idx, filename, original, patched)
+	if err != nil {
+		return "", err
+	}
+
+	if newFile != oldFile {
+		// the same NAR may belong to other store paths as well. The lock
+		// keeps new narinfos from picking it up before it's removed.
+		referenced, err := idx.referenced("nar/" + oldFile)
+		if err != nil {
+			slog.Warn("Couldn't check if the recompressed NAR is still used, keeping it", "file", oldFile, "error", err)
+		} else if referenced {
+			slog.Info("Keeping recompressed NAR, other narinfos still use it", "file", oldFile)
+		} else {
+			err = os.Remove(storePath + "/nar/" + oldFile)
+			if err != nil {
+				slog.Warn("Couldn't remove recompressed NAR", "file", oldFile, "error", err)
+			}
+		}
+	}
+	return newFile, nil
+}
+
+// patchNarInfo replaces the values of keys in a narinfo and keeps all other
+// lines. Keys the narinfo doesn't have are added after the last replaced
+// line.
+func patchNarInfo(data []byte, fields [][2]string) []byte {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var patched []string
+	done := map[string]bool{}
+	last := -1
+	for _, line := range lines {
+		key, _, _ := strings.Cut(line, ":")
+		replaced := false
+		for _, field := range fields {
+			if key == field[0] {
+				if !done[key] {
+					patched = append(patched, field[0]+": "+field[1]+"\n")
+					done[key] = true
+					last = len(patched)
+				}
+				replaced = true
+			}
+		}
+		if !replaced {
+			patched = append(patched, line)
+		}
+	}
+	if last < 0 {
+		last = len(patched)
+	}
+	var missing []string
+	for _, field := range fields {
+		if !done[field[0]] {
+			missing = append(missing, field[0]+": "+field[1]+"\n")
+		}
+	}
+	patched = append(patched[:last], append(missing, patched[last:]...)...)
+	return []byte(strings.Join(patched, ""))
+}
+
+// narIndex knows which narinfos of a store point to which NAR, so
+// recompression doesn't have to read all narinfos to find out whether a NAR
+// is still used. Narinfos written by this process update it, the ones
+// other processes like nix-stored import wrote are read when they show up.
+// mu is held while narinfos are replaced.
+type narIndex struct {
+	storePath string
+
+	mu    sync.Mutex
+	built bool
+	// narURLs are the NAR urls by store path hash, empty for broken
+	// narinfos
+	narURLs map[string]string
+	// users are the store path hashes by NAR url
+	users map[string]map[string]bool
+}
+
+var (
+	narIndexesMu sync.Mutex
+	narIndexes   = map[string]*narIndex{}
+)
+
+// narIndexOf returns the index of the store at storePath.
+func narIndexOf(storePath string) *narIndex {
+	narIndexesMu.Lock()
+	defer narIndexesMu.Unlock()
+	storePath = filepath.Clean(storePath)
+	idx, ok := narIndexes[storePath]
+	if !ok {
+		idx = &narIndex{storePath: storePath}
+		narIndexes[storePath] = idx
+	}
+	return idx
+}
+
+// set records the narinfo of storePathHash, data is nil if it's gone. mu
+// must be held.
+func (idx *narIndex) set(storePathHash string, data []byte) {
+	if !idx.built {
+		return
+	}
+	old, ok := idx.narURLs[storePathHash]
+	if ok {
+		delete(idx.users[old], storePathHash)
+		if len(idx.users[old]) == 0 {
+			delete(idx.users, old)
+		}
+		delete(idx.narURLs, storePathHash)
+	}
+	if data == nil {
+		return
+	}
+	narURL := ""
+	info, err := ParseNarInfo(bytes.NewReader(data))
+	if err == nil {
+		narURL = path.Clean(info.URL)
+		if idx.users[narURL] == nil {
+			idx.users[narURL] = map[string]bool{}
+		}
+		idx.users[narURL][storePathHash] = true
+	}
+	idx.narURLs[storePathHash] = narURL
+}
+
+// refresh reads the narinfos the index doesn't know yet. mu must be held.
+func (idx *narIndex) refresh() error {
+	hashes, err := listNarInfos(idx.storePath)
+	if err != nil {
+		return err
+	}
+	if !idx.built {
+		idx.narURLs = map[string]string{}
+		idx.users = map[string]map[string]bool{}
+		idx.built = true
+	}
+	for _, hash := range hashes {
+		if _, ok := idx.narURLs[hash]; ok {
+			continue
+		}
+		data, err := os.ReadFile(fmt.Sprintf("%s/%s.narinfo", idx.storePath, hash))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		idx.set(hash, data)
+	}
+	return nil
+}
+
+// referenced reports whether a narinfo in the store points to narURL. mu
+// must be held.
+func (idx *narIndex) referenced(narURL string) (bool, error) {
+	err := idx.refresh()
+	if err != nil {
+		return false, err
+	}
+	return len(idx.users[narURL]) > 0, nil
+}
+
+// recompressWorker recompresses the NARs of the narinfos sent to queue one
+// after another, so recompression never takes more than one transfer slot.
+// It returns when ctx is done.
+func (n NixStored) recompressWorker(ctx context.Context, queue <-chan string) {
+	for {
+		var narinfoFile string
+		select {
+		case <-ctx.Done():
+			return
+		case narinfoFile = <-queue:
+		}
+		err := n.limit.Acquire(ctx, 1)
+		if err != nil {
+			return
+		}
+		newFile, err := RecompressNar(n.StorePath, narinfoFile, n.Recompress)
+		n.limit.Release(1)
+		if err != nil {
+			slog.Warn("Couldn't recompress NAR", "narinfo", narinfoFile, "compression", n.Recompress, "error", err)
+			continue
+		}
+		if newFile == "" {
+			continue
+		}
+		slog.Info("Recompressed NAR", "narinfo", narinfoFile, "file", newFile)
+		// the build id index points to the old NAR
+		if n.IndexDebugInfo {
+			err = IndexBuildIDs(n.StorePath, newFile)
+			if err != nil {
+				slog.Warn("Couldn't index build ids", "file", newFile, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPatchNarInfo(t *testing.T) {
+	original := "StorePath: /nix/store/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-pkg\n" +
+		"URL: nar/old.nar\n" +
+		"Compression: none\n" +
+		"NarHash: sha256:1111111111111111111111111111111111111111111111111111\n" +
+		"NarSize: 3\n" +
+		"References: \n" +
+		"Unknown: kept\n"
+	patched := string(patchNarInfo([]byte(original), [][2]string{
+		{"URL", "nar/new.nar.zst"},
+		{"Compression", "zstd"},
+		{"FileHash", "sha256:2222222222222222222222222222222222222222222222222222"},
+		{"FileSize", "42"},
+	}))
+	want := "StorePath: /nix/store/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-pkg\n" +
+		"URL: nar/new.nar.zst\n" +
+		"Compression: zstd\n" +
+		"FileHash: sha256:2222222222222222222222222222222222222222222222222222\n" +
+		"FileSize: 42\n" +
+		"NarHash: sha256:1111111111111111111111111111111111111111111111111111\n" +
+		"NarSize: 3\n" +
+		"References: \n" +
+		"Unknown: kept\n"
+	if patched != want {
+		t.Errorf("got\n%s\nwant\n%s", patched, want)
+	}
+}
+
+func TestRecompressNarKeepsSharedNar(t *testing.T) {
+	storePath := t.TempDir()
+	err := os.Mkdir(storePath+"/nar", 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nar := []byte("not really a NAR, but recompression doesn't care")
+	sum := sha256.Sum256(nar)
+	narHash := nixBase32(sum[:])
+	err = os.WriteFile(storePath+"/nar/"+narHash+".nar", nar, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"} {
+		info := fmt.Sprintf("StorePath: /nix/store/%s-pkg\nURL: nar/%s.nar\nCompression: none\nNarHash: sha256:%s\nNarSize: %d\nReferences: \nUnknown: kept\n", hash, narHash, narHash, len(nar))
+		err = os.WriteFile(storePath+"/"+hash+".narinfo", []byte(info), 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := Recompression{Compression: "zstd", Level: 3}
+	newFile, err := RecompressNar(storePath, "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.narinfo", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(storePath + "/nar/" + narHash + ".nar")
+	if err != nil {
+		t.Fatalf("NAR used by the other narinfo was removed: %v", err)
+	}
+	data, err := os.ReadFile(storePath + "/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.narinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "URL: nar/"+newFile+"\n") || !strings.Contains(string(data), "Unknown: kept\n") {
+		t.Errorf("unexpected narinfo:\n%s", data)
+	}
+
+	// once nothing uses it anymore, it's removed
+	_, err = RecompressNar(storePath, "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb.narinfo", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(storePath + "/nar/" + narHash + ".nar")
+	if !os.IsNotExist(err) {
+		t.Errorf("unused NAR wasn't removed: %v", err)
+	}
+}
+
+func TestRecompressNarIndex(t *testing.T) {
+	storePath := t.TempDir()
+	err := os.Mkdir(storePath+"/nar", 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nar := []byte("not really a NAR, but recompression doesn't care")
+	sum := sha256.Sum256(nar)
+	narHash := nixBase32(sum[:])
+	err = os.WriteFile(storePath+"/nar/"+narHash+".nar", nar, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	narInfo := func(hash string, narFile string) []byte {
+		return []byte(fmt.Sprintf("StorePath: /nix/store/%s-pkg\nURL: nar/%s\nCompression: none\nNarHash: sha256:%s\nNarSize: %d\n", hash, narFile, narHash, len(nar)))
+	}
+	// narinfos written by other processes
+	write := func(hashes ...string) {
+		for _, hash := range hashes {
+			err := os.WriteFile(storePath+"/"+hash+".narinfo", narInfo(hash, narHash+".nar"), 0660)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	recompress := func(hash string) {
+		_, err := RecompressNar(storePath, hash+".narinfo", Recompression{Compression: "zstd", Level: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	narExists := func() bool {
+		_, err := os.Stat(storePath + "/nar/" + narHash + ".nar")
+		return err == nil
+	}
+
+	write("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	recompress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	if !narExists() {
+		t.Fatal("NAR used by b was removed")
+	}
+
+	// b now points elsewhere, c and d show up behind the back of the index
+	err = StoreNarInfo(storePath+"/bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb.narinfo", narInfo("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "other.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("cccccccccccccccccccccccccccccccc", "dddddddddddddddddddddddddddddddd")
+	recompress("cccccccccccccccccccccccccccccccc")
+	if !narExists() {
+		t.Fatal("NAR used by d was removed")
+	}
+	recompress("dddddddddddddddddddddddddddddddd")
+	if narExists() {
+		t.Error("unused NAR wasn't removed")
+	}
+}
+
+func TestReplaceNarInfoChanged(t *testing.T) {
+	storePath := t.TempDir()
+	filename := storePath + "/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.narinfo"
+	err := os.WriteFile(filename, []byte("uploaded again"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := narIndexOf(storePath)
+	idx.mu.Lock()
+	err = replaceNarInfo(idx, filename, []byte("original"), []byte("recompressed"))
+	idx.mu.Unlock()
+	if err == nil {
+		t.Fatal("replaced a changed narinfo")
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil || string(data) != "uploaded again" {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
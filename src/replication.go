@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ReplicationTarget is a binary cache uploaded paths are pushed to.
+// Credentials for uploading are given as user info of the url.
+type ReplicationTarget struct {
+	URL *url.URL
+}
+
+func (t ReplicationTarget) String() string {
+	return t.URL.Redacted()
+}
+
+// ParseReplicationTargets parses a space separated list of binary cache
+// urls.
+func ParseReplicationTargets(s string) ([]ReplicationTarget, error) {
+	var targets []ReplicationTarget
+	for _, field := range strings.Fields(s) {
+		u, err := url.Parse(field)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("Unsupported replication target %q, only http and https are supported", u.Redacted())
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		targets = append(targets, ReplicationTarget{URL: u})
+	}
+	return targets, nil
+}
+
+// Replicator pushes the paths uploaded to a cache to another binary cache.
+// The paths to push are queued on disk, so nothing is lost on restarts.
+// References are pushed before the paths referring to them, so the target
+// never has incomplete closures.
+type Replicator struct {
+	storePath string
+	target    *url.URL
+	queueDir  string
+	failedDir string
+	client    *http.Client
+	wake      chan struct{}
+
+	Pushed      atomic.Int64
+	Errors      atomic.Int64
+	Failed      atomic.Int64
+	LastSuccess atomic.Int64
+}
+
+// ErrUnreplicable is returned for paths that will never be pushed
+// successfully, like paths with an invalid narinfo or NARs the target
+// refuses. They are moved out of the queue instead of being retried.
+var ErrUnreplicable = errors.New("Path can't be replicated")
+
+// backoff of failed pushes
+const (
+	replicationMinBackoff = time.Second
+	replicationMaxBackoff = 5 * time.Minute
+)
+
+// NewReplicator creates the queue of a target. Each target has its own
+// queue below replication/, named after the url without credentials.
+// Paths that can't be replicated are moved to a directory next to it with
+// the suffix .failed.
+func NewReplicator(storePath string, target ReplicationTarget) (*Replicator, error) {
+	id := *target.URL
+	id.User = nil
+	sum := sha256.Sum256([]byte(id.String()))
+	queueDir := storePath + "/replication/" + hex.EncodeToString(sum[:8])
+	err := os.MkdirAll(queueDir, 0770)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(queueDir+".failed", 0770)
+	if err != nil {
+		return nil, err
+	}
+	return &Replicator{
+		storePath: storePath,
+		target:    target.URL,
+		queueDir:  queueDir,
+		failedDir: queueDir + ".failed",
+		client:    &http.Client{},
+		wake:      make(chan struct{}, 1),
+	}, nil
+}
+
+func (r *Replicator) String() string {
+	return r.target.Redacted()
+}
+
+// Enqueue queues a store path for pushing.
+func (r *Replicator) Enqueue(storePathHash string) {
+	err := os.WriteFile(r.queueDir+"/"+storePathHash, nil, 0660)
+	if err != nil {
+		slog.Error("Couldn't queue path for replication", "target", r, "storepathhash", storePathHash, "error", err)
+		return
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// queue returns the queued store path hashes, oldest first, and when the
+// oldest was queued.
+func (r *Replicator) queue() ([]string, time.Time, error) {
+	entries, err := os.ReadDir(r.queueDir)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	type queued struct {
+		hash string
+		time time.Time
+	}
+	var items []queued
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		items = append(items, queued{entry.Name(), info.ModTime()})
+	}
+	slices.SortFunc(items, func(a, b queued) int { return a.time.Compare(b.time) })
+
+	hashes := make([]string, len(items))
+	for i, item := range items {
+		hashes[i] = item.hash
+	}
+	if len(items) == 0 {
+		return hashes, time.Time{}, nil
+	}
+	return hashes, items[0].time, nil
+}
+
+// Lag returns the number of queued paths and the age of the oldest one.
+func (r *Replicator) Lag() (int, time.Duration) {
+	hashes, oldest, err := r.queue()
+	if err != nil || len(hashes) == 0 {
+		return 0, 0
+	}
+	return len(hashes), time.Since(oldest)
+}
+
+// Run pushes queued paths until ctx is done.
+func (r *Replicator) Run(ctx context.Context) {
+	backoff := replicationMinBackoff
+	for {
+		hashes, _, err := r.queue()
+		if err != nil {
+			slog.Error("Couldn't read replication queue", "target", r, "error", err)
+		}
+		failed := false
+		for _, hash := range hashes {
+			if ctx.Err() != nil {
+				return
+			}
+			err = r.push(ctx, hash, map[string]bool{})
+			if errors.Is(err, ErrUnreplicable) {
+				// don't block the paths queued after it
+				r.Errors.Add(1)
+				r.Failed.Add(1)
+				slog.Error("Giving up replicating path", "target", r, "storepathhash", hash, "error", err)
+				err = os.Rename(r.queueDir+"/"+hash, r.failedDir+"/"+hash)
+				if err != nil {
+					slog.Error("Couldn't move path out of the replication queue", "target", r, "storepathhash", hash, "error", err)
+					os.Remove(r.queueDir + "/" + hash)
+				}
+				continue
+			}
+			if err != nil {
+				r.Errors.Add(1)
+				slog.Warn("Couldn't replicate path", "target", r, "storepathhash", hash, "error", err, "retry", backoff)
+				failed = true
+				break
+			}
+			os.Remove(r.queueDir + "/" + hash)
+			r.LastSuccess.Store(time.Now().Unix())
+		}
+
+		wait := time.Minute
+		wake := r.wake
+		if failed {
+			wait = backoff
+			backoff = min(backoff*2, replicationMaxBackoff)
+			// new uploads don't cut the backoff short
+			wake = nil
+		} else {
+			backoff = replicationMinBackoff
+		}
+		// the queue is also polled, in case the wake up got lost
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// push pushes a path and the parts of its closure that are missing at the
+// target, references first. Paths we don't have ourselves are skipped.
+func (r *Replicator) push(ctx context.Context, storePathHash string, visited map[string]bool) error {
+	if visited[storePathHash] {
+		return nil
+	}
+	visited[storePathHash] = true
+
+	narinfoFile := fmt.Sprintf("%s/%s.narinfo", r.storePath, storePathHash)
+	data, err := os.ReadFile(narinfoFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := ParseNarInfo(strings.NewReader(string(data)))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnreplicable, err)
+	}
+
+	exists, err := r.exists(ctx, storePathHash)
+	if err != nil || exists {
+		return err
+	}
+
+	for _, ref := range info.References {
+		if len(ref) < 32 || ref[:32] == storePathHash {
+			continue
+		}
+		err = r.push(ctx, ref[:32], visited)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = r.upload(ctx, storePathHash, data, info)
+	if err != nil {
+		return err
+	}
+	r.Pushed.Add(1)
+	return nil
+}
+
+// upload uploads the NAR and the narinfo of a path.
+func (r *Replicator) upload(ctx context.Context, storePathHash string, data []byte, info *NarInfo) error {
+	dir, narFile := path.Split(path.Clean(info.URL))
+	if dir != "nar/" {
+		return fmt.Errorf("%w: NAR %q isn't stored in this cache", ErrUnreplicable, info.URL)
+	}
+	nar, err := os.Open(r.storePath + "/nar/" + narFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrUnreplicable, err)
+	}
+	if err != nil {
+		return err
+	}
+	defer nar.Close()
+	err = r.put(ctx, "nar/"+narFile, "application/x-nix-nar", nar)
+	if err != nil {
+		return err
+	}
+	// the narinfo comes last, so the path only shows up when it's complete
+	err = r.put(ctx, storePathHash+".narinfo", "text/x-nix-narinfo", strings.NewReader(string(data)))
+	if err != nil {
+		return err
+	}
+	slog.Debug("Replicated path", "target", r, "storepath", info.StorePath)
+	return nil
+}
+
+func (r *Replicator) exists(ctx context.Context, storePathHash string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, r.target.JoinPath(storePathHash+".narinfo").String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound, http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+}
+
+func (r *Replicator) put(ctx context.Context, file string, contentType string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.target.JoinPath(file).String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "nix-stored")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge:
+		// the target rejects the file itself, retrying won't help
+		return fmt.Errorf("%w: Upload of %s failed with %s", ErrUnreplicable, file, resp.Status)
+	default:
+		return fmt.Errorf("Upload of %s failed with %s", file, resp.Status)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTarget is a binary cache accepting all uploads.
+type testTarget struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (t *testTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch r.Method {
+	case http.MethodHead:
+		if _, ok := t.files[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		t.files[r.URL.Path] = string(data)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func TestReplicatorSkipsUnreplicablePaths(t *testing.T) {
+	storePath := t.TempDir()
+	err := os.Mkdir(storePath+"/nar", 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.narinfo": "not a narinfo\n",
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb.narinfo": "StorePath: /nix/store/bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb-pkg\nURL: nar/missing.nar\nCompression: none\nNarHash: sha256:1111111111111111111111111111111111111111111111111111\nNarSize: 3\n",
+		"cccccccccccccccccccccccccccccccc.narinfo": "StorePath: /nix/store/cccccccccccccccccccccccccccccccc-pkg\nURL: nar/good.nar\nCompression: none\nNarHash: sha256:1111111111111111111111111111111111111111111111111111\nNarSize: 3\n",
+		"nar/good.nar": "nar",
+	}
+	for file, data := range files {
+		err = os.WriteFile(storePath+"/"+file, []byte(data), 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := &testTarget{files: map[string]string{}}
+	server := httptest.NewServer(target)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	r, err := NewReplicator(storePath, ReplicationTarget{URL: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the broken paths are queued first
+	for _, hash := range []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "cccccccccccccccccccccccccccccccc"} {
+		r.Enqueue(hash)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for length, _ := r.Lag(); length > 0 && time.Now().Before(deadline); length, _ = r.Lag() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if length, _ := r.Lag(); length != 0 {
+		t.Fatalf("%d paths are still queued", length)
+	}
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if target.files["/cccccccccccccccccccccccccccccccc.narinfo"] != files["cccccccccccccccccccccccccccccccc.narinfo"] || target.files["/nar/good.nar"] != "nar" {
+		t.Errorf("the valid path wasn't replicated, target has %v", target.files)
+	}
+	if r.Failed.Load() != 2 {
+		t.Errorf("gave up on %d paths, want 2", r.Failed.Load())
+	}
+	for _, hash := range []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"} {
+		_, err = os.Stat(r.failedDir + "/" + hash)
+		if err != nil {
+			t.Errorf("%s wasn't moved aside: %v", hash, err)
+		}
+	}
+}
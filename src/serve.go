@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ChrisOboe/nix-stored/api"
+	"github.com/oapi-codegen/runtime/strictmiddleware/nethttp"
+)
+
+// CacheControl is the caching policy announced to proxies and CDNs in front
+// of a cache. A max age of 0 disables caching.
+type CacheControl struct {
+	Private        bool
+	NarMaxAge      time.Duration
+	NarInfoMaxAge  time.Duration
+	NegativeMaxAge time.Duration
+}
+
+// Nar returns the Cache-Control header of NARs. They are content addressed
+// and never change.
+func (c CacheControl) Nar() string {
+	return c.header(c.NarMaxAge, "immutable")
+}
+
+// NarInfo returns the Cache-Control header of existing narinfos.
+func (c CacheControl) NarInfo() string {
+	return c.header(c.NarInfoMaxAge)
+}
+
+// Negative returns the Cache-Control header of narinfos that don't exist
+// (yet).
+func (c CacheControl) Negative() string {
+	return c.header(c.NegativeMaxAge)
+}
+
+func (c CacheControl) header(maxAge time.Duration, extra ...string) string {
+	if maxAge == 0 {
+		return "no-cache"
+	}
+	directives := []string{"public"}
+	if c.Private {
+		directives[0] = "private"
+	}
+	directives = append(directives, fmt.Sprintf("max-age=%d", int64(maxAge.Seconds())))
+	return strings.Join(append(directives, extra...), ", ")
+}
+
+type requestKey struct{}
+
+// RequestMiddleware makes the http request available to the response types
+// via the context. The generated response types only get the
+// ResponseWriter, but Range and conditional requests need the request.
+func RequestMiddleware() api.StrictMiddlewareFunc {
+	return func(f nethttp.StrictHTTPHandlerFunc, operationID string) nethttp.StrictHTTPHandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request, request interface{}) (response interface{}, err error) {
+			return f(context.WithValue(ctx, requestKey{}, r), w, r, request)
+		}
+	}
+}
+
+// fileResponse serves a stored file with http.ServeContent, which handles
+// Range, If-None-Match, If-Modified-Since and If-Range. Because the body is
+// an *os.File the data is sent with sendfile.
+type fileResponse struct {
+	file         *os.File
+	request      *http.Request
+	contentType  string
+	cacheControl string
+	etag         string
+}
+
+// newFileResponse creates a fileResponse. An empty etag is derived from
+// the size and modification time of the file, which is good enough for
+// files that are replaced as a whole.
+func newFileResponse(ctx context.Context, file *os.File, contentType string, cacheControl string, etag string) (fileResponse, error) {
+	request, ok := ctx.Value(requestKey{}).(*http.Request)
+	if !ok {
+		return fileResponse{}, fmt.Errorf("Request missing in context")
+	}
+	if etag == "" {
+		info, err := file.Stat()
+		if err != nil {
+			return fileResponse{}, err
+		}
+		etag = fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano())
+	}
+	return fileResponse{
+		file:         file,
+		request:      request,
+		contentType:  contentType,
+		cacheControl: cacheControl,
+		etag:         `"` + etag + `"`,
+	}, nil
+}
+
+func (response fileResponse) serve(w http.ResponseWriter) error {
+	defer response.file.Close()
+	info, err := response.file.Stat()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", response.contentType)
+	w.Header().Set("Cache-Control", response.cacheControl)
+	w.Header().Set("ETag", response.etag)
+	http.ServeContent(w, response.request, "", info.ModTime(), response.file)
+	return nil
+}
+
+func (response fileResponse) VisitGetCompressedNarResponse(w http.ResponseWriter) error {
+	return response.serve(w)
+}
+
+func (response fileResponse) VisitGetUncompressedNarResponse(w http.ResponseWriter) error {
+	return response.serve(w)
+}
+
+func (response fileResponse) VisitGetNarInfoResponse(w http.ResponseWriter) error {
+	return response.serve(w)
+}
+
+// notFoundResponse is a 404 that may be cached for a short time, so misses
+// don't reach us all the time but uploads are found soon.
+type notFoundResponse struct {
+	cacheControl string
+}
+
+func (response notFoundResponse) serve(w http.ResponseWriter) error {
+	w.Header().Set("Cache-Control", response.cacheControl)
+	w.WriteHeader(404)
+	return nil
+}
+
+func (response notFoundResponse) VisitGetNarInfoResponse(w http.ResponseWriter) error {
+	return response.serve(w)
+}
+
+func (response notFoundResponse) VisitDoesNarInfoExistResponse(w http.ResponseWriter) error {
+	return response.serve(w)
+}
+
+// streamResponse serves a NAR that is fetched from an upstream cache.
+type streamResponse struct {
+	body         io.ReadCloser
+	size         int64
+	cacheControl string
+}
+
+func (response streamResponse) serve(w http.ResponseWriter) error {
+	defer response.body.Close()
+	w.Header().Set("Content-Type", "application/x-nix-nar")
+	w.Header().Set("Cache-Control", response.cacheControl)
+	if response.size >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(response.size))
+	}
+	w.WriteHeader(200)
+	// the response is cut short if the download fails, so the client
+	// notices it
+	_, err := io.Copy(w, response.body)
+	if err != nil {
+		slog.Warn("Couldn't stream NAR", "error", err)
+	}
+	return nil
+}
+
+func (response streamResponse) VisitGetCompressedNarResponse(w http.ResponseWriter) error {
+	return response.serve(w)
+}
+
+func (response streamResponse) VisitGetUncompressedNarResponse(w http.ResponseWriter) error {
+	return response.serve(w)
+}
+
+// narInfoResponse serves a generated narinfo.
+type narInfoResponse struct {
+	body         string
+	cacheControl string
+}
+
+func (response narInfoResponse) VisitGetNarInfoResponse(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "text/x-nix-narinfo")
+	w.Header().Set("Cache-Control", response.cacheControl)
+	w.Header().Set("Content-Length", fmt.Sprint(len(response.body)))
+	w.WriteHeader(200)
+	_, err := io.WriteString(w, response.body)
+	return err
+}
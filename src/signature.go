@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// PublicKeys maps key names to ed25519 keys, like nix's
+// trusted-public-keys.
+type PublicKeys map[string]ed25519.PublicKey
+
+// ParsePublicKeys parses a whitespace separated list of keys in the
+// name:base64 format nix uses.
+func ParsePublicKeys(keys string) (PublicKeys, error) {
+	parsed := PublicKeys{}
+	for _, key := range strings.Fields(keys) {
+		name, data, ok := strings.Cut(key, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("Public key %q has no name", key)
+		}
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't decode public key %s: %w", name, err)
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Public key %s has the wrong size", name)
+		}
+		parsed[name] = ed25519.PublicKey(raw)
+	}
+	return parsed, nil
+}
+
+// Verify reports whether sig, in the name:base64 format, is a valid
+// signature of fingerprint made with one of the keys.
+func (k PublicKeys) Verify(fingerprint string, sig string) bool {
+	name, data, ok := strings.Cut(sig, ":")
+	if !ok {
+		return false
+	}
+	key, ok := k[name]
+	if !ok {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || len(raw) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(key, []byte(fingerprint), raw)
+}
+
+// VerifyAny reports whether at least one of sigs is valid.
+func (k PublicKeys) VerifyAny(fingerprint string, sigs []string) bool {
+	for _, sig := range sigs {
+		if k.Verify(fingerprint, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// SecretKey is a signing key in the name:base64 format of
+// nix-store --generate-binary-cache-key.
+type SecretKey struct {
+	Name string
+	Key  ed25519.PrivateKey
+}
+
+// ParseSecretKey parses a secret key. Surrounding whitespace, like the
+// newline at the end of a key file, is ignored.
+func ParseSecretKey(key string) (*SecretKey, error) {
+	name, data, ok := strings.Cut(strings.TrimSpace(key), ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("Secret key has no name")
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode secret key %s: %w", name, err)
+	}
+	if len(raw) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("Secret key %s has the wrong size", name)
+	}
+	return &SecretKey{Name: name, Key: ed25519.PrivateKey(raw)}, nil
+}
+
+// Sign returns a signature of fingerprint in the name:base64 format.
+func (k *SecretKey) Sign(fingerprint string) string {
+	return k.Name + ":" + base64.StdEncoding.EncodeToString(ed25519.Sign(k.Key, []byte(fingerprint)))
+}
+
+// String returns the name only, so the key doesn't end up in logs.
+func (k *SecretKey) String() string {
+	return k.Name
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+// SyncOptions select what Sync copies between a cache and a remote cache.
+type SyncOptions struct {
+	Remote Upstream
+	Push   bool
+	Pull   bool
+	// System and Name filter the paths to copy. Name is a glob pattern
+	// matched against the name of the store path, without the hash.
+	System string
+	Name   string
+	// Roots limit the paths to their closures
+	Roots  []string
+	DryRun bool
+}
+
+// Validate checks the roots and the name pattern.
+func (o SyncOptions) Validate() error {
+	for _, root := range o.Roots {
+		hash, _, _ := strings.Cut(path.Base(root), "-")
+		if !storePathHashRegex.MatchString(hash) {
+			return fmt.Errorf("Invalid root %q", root)
+		}
+	}
+	if o.Name != "" {
+		_, err := path.Match(o.Name, "")
+		if err != nil {
+			return fmt.Errorf("Invalid name pattern %q: %w", o.Name, err)
+		}
+	}
+	if !o.Push && !o.Pull {
+		return fmt.Errorf("Nothing to sync, neither pushing nor pulling")
+	}
+	return nil
+}
+
+// Sync copies the paths missing in the cache at storePath or the remote
+// cache to the other one. Closures are always copied completely, so
+// references of the selected paths are copied even if they don't match
+// the filters. Paths are pulled with proxy, the proxy of the cache. copied
+// is called for every path that was copied or failed if it isn't nil.
+func Sync(ctx context.Context, proxy *Proxy, opts SyncOptions, copied func(storePath string, err error)) (api.SyncResult, error) {
+	result := api.SyncResult{Pushed: []string{}, Pulled: []string{}, Failed: []string{}}
+	err := opts.Validate()
+	if err != nil {
+		return result, err
+	}
+	roots := make([]string, len(opts.Roots))
+	for i, root := range opts.Roots {
+		roots[i], _, _ = strings.Cut(path.Base(root), "-")
+	}
+
+	storePath := proxy.storePath
+	s := syncer{
+		opts:      opts,
+		local:     storePath,
+		pusher:    &Replicator{storePath: storePath, target: opts.Remote.URL, client: &http.Client{}},
+		proxy:     proxy,
+		upstreams: []Upstream{opts.Remote},
+		copied:    copied,
+	}
+	localHashes, err := listNarInfos(storePath)
+	if err != nil {
+		return result, err
+	}
+	s.remoteHashes, err = s.listRemote(ctx)
+	if err != nil {
+		return result, err
+	}
+	if s.remoteHashes == nil && len(roots) == 0 && opts.Pull {
+		return result, fmt.Errorf("%s can't list its narinfos, pulling from it needs roots", opts.Remote)
+	}
+
+	if opts.Push {
+		candidates := roots
+		if len(candidates) == 0 {
+			candidates = localHashes
+		}
+		err = s.push(ctx, candidates, &result)
+		if err != nil {
+			return result, err
+		}
+	}
+	if opts.Pull {
+		candidates := roots
+		if len(candidates) == 0 {
+			for hash := range s.remoteHashes {
+				candidates = append(candidates, hash)
+			}
+			slices.Sort(candidates)
+		}
+		err = s.pull(ctx, candidates, &result)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// SyncJob runs Sync in the background.
+type SyncJob struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	status   api.SyncStatus
+	finished time.Time
+}
+
+// StartSync starts a sync with w. pulled is called for every pulled path
+// once the sync finished.
+func StartSync(w *workers, proxy *Proxy, opts SyncOptions, pulled func(storePath string)) (*SyncJob, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(w.ctx)
+	j := &SyncJob{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		status: api.SyncStatus{Id: id, State: api.SyncStatusStateRunning},
+	}
+	w.Go(func(context.Context) { j.run(ctx, proxy, opts, pulled) })
+	return j, nil
+}
+
+func (j *SyncJob) run(ctx context.Context, proxy *Proxy, opts SyncOptions, pulled func(storePath string)) {
+	defer close(j.done)
+	defer j.cancel()
+
+	slog.Info("Syncing", "id", j.status.Id, "remote", opts.Remote, "dryrun", opts.DryRun)
+	result, err := Sync(ctx, proxy, opts, func(storePath string, err error) {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if err != nil {
+			j.status.Failed++
+		} else {
+			j.status.Copied++
+		}
+	})
+	// pulled paths are passed on like uploaded ones
+	if !opts.DryRun && pulled != nil {
+		for _, storePath := range result.Pulled {
+			pulled(storePath)
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	j.status.Result = &result
+	switch {
+	case ctx.Err() != nil:
+		j.status.State = api.SyncStatusStateCanceled
+	case err != nil:
+		j.status.State = api.SyncStatusStateFailed
+		message := err.Error()
+		j.status.Error = &message
+	default:
+		j.status.State = api.SyncStatusStateDone
+	}
+	slog.Info("Sync finished", "id", j.status.Id, "remote", opts.Remote, "state", j.status.State, "pushed", len(result.Pushed), "pulled", len(result.Pulled), "failed", len(result.Failed), "dryrun", opts.DryRun)
+}
+
+// Status returns the progress of the sync.
+func (j *SyncJob) Status() api.SyncStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Cancel stops the sync. The path being pulled isn't added to the cache.
+func (j *SyncJob) Cancel() {
+	j.cancel()
+}
+
+func (j *SyncJob) finishedAt() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finished
+}
+
+// Done is closed when the sync finished.
+func (j *SyncJob) Done() <-chan struct{} {
+	return j.done
+}
+
+type syncer struct {
+	opts   SyncOptions
+	local  string
+	pusher *Replicator
+	proxy  *Proxy
+	// upstreams are where paths are pulled from
+	upstreams []Upstream
+	// remoteHashes is nil if the remote can't list its narinfos
+	remoteHashes map[string]bool
+	// copied is called for every path that was copied or failed
+	copied func(storePath string, err error)
+}
+
+// syncPath is a path to copy with its narinfo.
+type syncPath struct {
+	hash   string
+	data   []byte
+	info   *NarInfo
+	narURL *url.URL
+}
+
+// matches applies the filters of the options.
+func (s *syncer) matches(info *NarInfo) bool {
+	if s.opts.System != "" && info.System != s.opts.System {
+		return false
+	}
+	if s.opts.Name != "" {
+		_, name, _ := strings.Cut(path.Base(info.StorePath), "-")
+		ok, _ := path.Match(s.opts.Name, name)
+		return ok
+	}
+	return true
+}
+
+// listRemote lists the narinfos of a remote nix-stored. It returns nil if
+// the remote can't list them, like most binary caches.
+func (s *syncer) listRemote(ctx context.Context) (map[string]bool, error) {
+	resp, err := s.proxy.get(ctx, s.opts.Remote.URL.JoinPath("narinfos"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Couldn't list narinfos of %s: %s", s.opts.Remote, resp.Status)
+	}
+	hashes := map[string]bool{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		hash := scanner.Text()
+		if storePathHashRegex.MatchString(hash) {
+			hashes[hash] = true
+		}
+	}
+	return hashes, scanner.Err()
+}
+
+// remoteHas checks whether the remote has a path, with the listing if
+// there is one.
+func (s *syncer) remoteHas(ctx context.Context, hash string) (bool, error) {
+	if s.remoteHashes != nil {
+		return s.remoteHashes[hash], nil
+	}
+	return s.pusher.exists(ctx, hash)
+}
+
+func (s *syncer) localHas(hash string) (bool, error) {
+	_, err := os.Stat(fmt.Sprintf("%s/%s.narinfo", s.local, hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// lookupLocal returns a path of this cache, or nil if it doesn't have it.
+func (s *syncer) lookupLocal(hash string) (*syncPath, error) {
+	data, err := os.ReadFile(fmt.Sprintf("%s/%s.narinfo", s.local, hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := ParseNarInfo(strings.NewReader(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse narinfo of %s: %w", hash, err)
+	}
+	return &syncPath{hash: hash, data: data, info: info}, nil
+}
+
+// lookupRemote returns a verified path of the first upstream that has it, or nil if none has it. Paths this cache has are taken from
+// it, there is nothing to fetch for them but their references. Broken
+// upstreams are skipped, it only fails if none of them answered.
+func (s *syncer) lookupRemote(hash string) (*syncPath, error) {
+	p, err := s.lookupLocal(hash)
+	if err != nil || p != nil {
+		return p, err
+	}
+	var lastErr error
+	answered := false
+	for _, upstream := range s.upstreams {
+		info, narURL, err := s.proxy.fetchNarInfoFrom(upstream, hash)
+		if err != nil {
+			slog.Warn("Couldn't fetch narinfo from upstream", "upstream", upstream, "storepathhash", hash, "error", err)
+			lastErr = fmt.Errorf("Couldn't fetch narinfo of %s from %s: %w", hash, upstream, err)
+			continue
+		}
+		answered = true
+		if info != nil {
+			return &syncPath{hash: hash, info: info, narURL: narURL}, nil
+		}
+	}
+	if !answered {
+		return nil, lastErr
+	}
+	return nil, nil
+}
+
+func (s *syncer) push(ctx context.Context, candidates []string, result *api.SyncResult) error {
+	has := func(hash string) (bool, error) { return s.remoteHas(ctx, hash) }
+	paths, broken, err := s.plan(ctx, candidates, s.lookupLocal, has)
+	if err != nil {
+		return err
+	}
+	s.copyPaths(ctx, paths, broken, &result.Pushed, &result.Failed, func(p syncPath) error {
+		return s.pusher.upload(ctx, p.hash, p.data, p.info)
+	})
+	return ctx.Err()
+}
+
+func (s *syncer) pull(ctx context.Context, candidates []string, result *api.SyncResult) error {
+	paths, broken, err := s.plan(ctx, candidates, s.lookupRemote, s.localHas)
+	if err != nil {
+		return err
+	}
+	s.copyPaths(ctx, paths, broken, &result.Pulled, &result.Failed, func(p syncPath) error {
+		return s.proxy.pull(ctx, p.hash, p.info, p.narURL)
+	})
+	return ctx.Err()
+}
+
+// plan returns the candidates matching the filters that the destination
+// doesn't have, together with the missing parts of their closures,
+// references first. lookup looks up a path at the source, has checks for
+// it at the destination. broken are the references neither has.
+func (s *syncer) plan(ctx context.Context, candidates []string, lookup func(hash string) (*syncPath, error), has func(hash string) (bool, error)) ([]syncPath, map[string]bool, error) {
+	looked := map[string]*syncPath{}
+	get := func(hash string) (*syncPath, error) {
+		p, ok := looked[hash]
+		if ok {
+			return p, nil
+		}
+		p, err := lookup(hash)
+		if err != nil {
+			return nil, err
+		}
+		looked[hash] = p
+		return p, nil
+	}
+
+	// with roots, the candidates are their closures at the source
+	if len(s.opts.Roots) > 0 {
+		closure := []string{}
+		seen := map[string]bool{}
+		queue := candidates
+		for len(queue) > 0 {
+			hash := queue[0]
+			queue = queue[1:]
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			p, err := get(hash)
+			if err != nil {
+				return nil, nil, err
+			}
+			if p == nil {
+				continue
+			}
+			closure = append(closure, hash)
+			for _, ref := range p.info.References {
+				if len(ref) >= 32 {
+					queue = append(queue, ref[:32])
+				}
+			}
+		}
+		candidates = closure
+	}
+
+	var paths []syncPath
+	broken := map[string]bool{}
+	visited := map[string]bool{}
+	var visit func(hash string) error
+	visit = func(hash string) error {
+		if visited[hash] {
+			return nil
+		}
+		visited[hash] = true
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ok, err := has(hash)
+		if err != nil || ok {
+			return err
+		}
+		p, err := get(hash)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			broken[hash] = true
+			return nil
+		}
+		for _, ref := range p.info.References {
+			if len(ref) >= 32 && ref[:32] != hash {
+				err = visit(ref[:32])
+				if err != nil {
+					return err
+				}
+			}
+		}
+		paths = append(paths, *p)
+		return nil
+	}
+	for _, hash := range candidates {
+		if visited[hash] {
+			continue
+		}
+		ok, err := has(hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			visited[hash] = true
+			continue
+		}
+		p, err := get(hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if p == nil || !s.matches(p.info) {
+			continue
+		}
+		err = visit(hash)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return paths, broken, nil
+}
+
+// copyPaths copies paths, which are ordered references first. Paths referring
+// to a broken path or a path that couldn't be copied are skipped, so no
+// closure is left incomplete.
+func (s *syncer) copyPaths(ctx context.Context, paths []syncPath, broken map[string]bool, copied *[]string, failed *[]string, copyPath func(p syncPath) error) {
+	for _, p := range paths {
+		if ctx.Err() != nil {
+			return
+		}
+		skip := false
+		for _, ref := range p.info.References {
+			if len(ref) >= 32 && broken[ref[:32]] {
+				skip = true
+			}
+		}
+		if skip {
+			slog.Warn("Skipping path with incomplete closure", "storepath", p.info.StorePath)
+			broken[p.hash] = true
+			*failed = append(*failed, p.info.StorePath)
+			s.report(p.info.StorePath, errIncompleteClosure)
+			continue
+		}
+		if !s.opts.DryRun {
+			err := copyPath(p)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Warn("Couldn't copy path", "storepath", p.info.StorePath, "error", err)
+				broken[p.hash] = true
+				*failed = append(*failed, p.info.StorePath)
+				s.report(p.info.StorePath, err)
+				continue
+			}
+			slog.Info("Copied path", "storepath", p.info.StorePath)
+		}
+		*copied = append(*copied, p.info.StorePath)
+		s.report(p.info.StorePath, nil)
+	}
+}
+
+var errIncompleteClosure = errors.New("A reference of the path is missing")
+
+func (s *syncer) report(storePath string, err error) {
+	if s.copied != nil {
+		s.copied(storePath, err)
+	}
+}
+
+// listNarInfos returns the store path hashes of all narinfos in a cache.
+func listNarInfos(storePath string) ([]string, error) {
+	entries, err := os.ReadDir(storePath)
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for _, entry := range entries {
+		hash, ok := strings.CutSuffix(entry.Name(), ".narinfo")
+		if ok && storePathHashRegex.MatchString(hash) {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes, nil
+}
+
+// narInfoListResponse streams the store path hashes of all narinfos.
+type narInfoListResponse struct {
+	storePath string
+}
+
+func (r narInfoListResponse) VisitListNarInfosResponse(w http.ResponseWriter) error {
+	hashes, err := listNarInfos(r.storePath)
+	if err != nil {
+		slog.Error("Couldn't list narinfos", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	bw := bufio.NewWriter(w)
+	for _, hash := range hashes {
+		io.WriteString(bw, hash+"\n")
+	}
+	return bw.Flush()
+}
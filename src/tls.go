@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSSettings configures TLS termination. TLS is disabled if CertFile is
+// empty. Client certificates signed by ClientCA are verified if ClientCA
+// isn't empty.
+type TLSSettings struct {
+	CertFile          string
+	KeyFile           string
+	MinVersion        uint16
+	H2C               bool
+	ClientCA          string
+	ClientCRL         string
+	RequireClientCert bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSSettingsFromEnv reads the TLS settings from the environment.
+func TLSSettingsFromEnv() (TLSSettings, error) {
+	var s TLSSettings
+	var err error
+	s.CertFile = os.Getenv("NIX_STORED_TLS_CERT")
+	s.KeyFile = os.Getenv("NIX_STORED_TLS_KEY")
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return TLSSettings{}, fmt.Errorf("NIX_STORED_TLS_CERT and NIX_STORED_TLS_KEY must be set together")
+	}
+
+	version := defaultEnv("NIX_STORED_TLS_MIN_VERSION", "1.2")
+	minVersion, ok := tlsVersions[version]
+	if !ok {
+		return TLSSettings{}, fmt.Errorf("Unsupported TLS version %q", version)
+	}
+	s.MinVersion = minVersion
+
+	s.H2C, err = boolEnv("NIX_STORED_H2C", false)
+	if err != nil {
+		return TLSSettings{}, err
+	}
+
+	s.ClientCA = os.Getenv("NIX_STORED_TLS_CLIENT_CA")
+	s.ClientCRL = os.Getenv("NIX_STORED_TLS_CLIENT_CRL")
+	s.RequireClientCert, err = boolEnv("NIX_STORED_TLS_REQUIRE_CLIENT_CERT", false)
+	if err != nil {
+		return TLSSettings{}, err
+	}
+	if s.ClientCA == "" && (s.ClientCRL != "" || s.RequireClientCert) {
+		return TLSSettings{}, fmt.Errorf("Client certificates need NIX_STORED_TLS_CLIENT_CA")
+	}
+	if s.ClientCA != "" && s.CertFile == "" {
+		return TLSSettings{}, fmt.Errorf("NIX_STORED_TLS_CLIENT_CA needs NIX_STORED_TLS_CERT")
+	}
+	return s, nil
+}
+
+// certReloader loads the certificate again when the cert or key file
+// changes, so certificates can be rotated without a restart. Established
+// connections keep the certificate they were started with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// how often the files are checked for changes at most
+const certCheckInterval = 10 * time.Second
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := c.reload()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	c.checked = time.Now()
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		slog.Info("Reloaded TLS certificate", "file", c.certFile)
+	}
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		// keep serving the old certificate if the new one is broken, e.g.
+		// because only one of the files was replaced yet
+		err := c.reload()
+		if err != nil {
+			slog.Warn("Couldn't reload TLS certificate", "file", c.certFile, "error", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// TLSConfig returns the tls.Config for the server or nil if TLS is
+// disabled.
+func (s TLSSettings) TLSConfig() (*tls.Config, error) {
+	if s.CertFile == "" {
+		return nil, nil
+	}
+	reloader, err := newCertReloader(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:     s.MinVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if s.ClientCA == "" {
+		return config, nil
+	}
+
+	// clients without certificate can still use passwords, unless
+	// certificates are required
+	caPEM, err := os.ReadFile(s.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read client CA: %w", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%s has no PEM certificates", s.ClientCA)
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if s.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if s.ClientCRL != "" {
+		crl, err := newCRLReloader(s.ClientCRL)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load CRL: %w", err)
+		}
+		config.VerifyConnection = crl.VerifyConnection
+	}
+	return config, nil
+}
+
+// crlReloader checks client certificates against certificate revocation
+// lists, which are loaded again when their file changes.
+type crlReloader struct {
+	file string
+
+	mu      sync.Mutex
+	crls    []*x509.RevocationList
+	mod     time.Time
+	checked time.Time
+}
+
+func newCRLReloader(file string) (*crlReloader, error) {
+	c := &crlReloader{file: file}
+	err := c.reload()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *crlReloader) reload() error {
+	c.checked = time.Now()
+	info, err := os.Stat(c.file)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(c.mod) {
+		return nil
+	}
+	data, err := os.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	crls, err := parseCRLs(data)
+	if err != nil {
+		return err
+	}
+	for _, crl := range crls {
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			slog.Warn("CRL is outdated", "file", c.file, "issuer", crl.Issuer, "nextupdate", crl.NextUpdate)
+		}
+	}
+	if c.crls != nil {
+		slog.Info("Reloaded CRL", "file", c.file)
+	}
+	c.crls = crls
+	c.mod = info.ModTime()
+	return nil
+}
+
+// parseCRLs parses PEM or DER encoded CRLs. A PEM file may have several.
+func parseCRLs(data []byte) ([]*x509.RevocationList, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+	var crls []*x509.RevocationList
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, errors.New("No CRL found")
+	}
+	return crls, nil
+}
+
+// VerifyConnection implements tls.Config.VerifyConnection. A client
+// certificate is rejected if every verified chain has a certificate that
+// a CRL of its issuer revokes.
+func (c *crlReloader) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	if time.Since(c.checked) >= certCheckInterval {
+		err := c.reload()
+		if err != nil {
+			slog.Warn("Couldn't reload CRL", "file", c.file, "error", err)
+		}
+	}
+	crls := c.crls
+	c.mu.Unlock()
+
+	var revoked *x509.Certificate
+	for _, chain := range state.VerifiedChains {
+		revoked = revokedCert(chain, crls)
+		if revoked == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("Certificate %s (serial %s) is revoked", revoked.Subject, revoked.SerialNumber)
+}
+
+// revokedCert returns the first certificate of a chain that is revoked by
+// a CRL signed by its issuer.
+func revokedCert(chain []*x509.Certificate, crls []*x509.RevocationList) *x509.Certificate {
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, crl := range crls {
+			if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			for _, entry := range crl.RevokedCertificateEntries {
+				if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return cert
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+// tokenPrefix starts every token, so tokens can be told apart from
+// passwords when they are sent as basic auth password.
+const tokenPrefix = "nst_"
+
+var tokenIDRegex = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// ErrInvalidToken is returned for unknown, revoked and expired tokens.
+var ErrInvalidToken = errors.New("Invalid token")
+
+// Token is a stored API token. Only the sha256 of its secret is stored.
+type Token struct {
+	api.TokenInfo
+	Hash string `json:"hash"`
+}
+
+// TokenStore are the API tokens of all caches, a file per token. Tokens
+// are read for every request, so revoked tokens are rejected right away.
+type TokenStore struct {
+	dir string
+}
+
+func NewTokenStore(dir string) *TokenStore {
+	return &TokenStore{dir: dir}
+}
+
+// operationScope returns the scope an operation needs.
+func operationScope(operationID string) api.TokenScope {
+	switch operationID {
+	case "PutNarFileHashNarCompression", "PutUncompressedNar", "PutStorePathHashNarinfo", "PutStorePathHashLs", "PutLogDeriver", "PutRealisation", "PutDebugInfo", "IngestClosure":
+		return api.Write
+	case "CancelPrefetch", "CancelSync", "RevokeToken":
+		return api.Delete
+	case "Sync", "GetSync", "StartPrefetch", "ListTokens", "CreateToken":
+		return api.Admin
+	}
+	return api.Read
+}
+
+// grants reports whether a role includes a scope. Only admins may delete.
+func (r Role) grants(scope api.TokenScope) bool {
+	switch scope {
+	case api.Read:
+		return r >= RoleRead
+	case api.Write:
+		return r >= RoleWrite
+	}
+	return r >= RoleAdmin
+}
+
+// ParseTokenScopes parses a comma separated list of scopes.
+func ParseTokenScopes(s string) ([]api.TokenScope, error) {
+	var scopes []api.TokenScope
+	for _, name := range strings.Split(s, ",") {
+		scope := api.TokenScope(strings.TrimSpace(name))
+		if !validTokenScope(scope) {
+			return nil, fmt.Errorf("Unknown scope %q, must be read, write, delete or admin", name)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+func validTokenScope(scope api.TokenScope) bool {
+	switch scope {
+	case api.Read, api.Write, api.Delete, api.Admin:
+		return true
+	}
+	return false
+}
+
+// checkTokenRequest checks a token request and returns its ttl.
+func checkTokenRequest(req api.TokenRequest) (time.Duration, error) {
+	if len(req.Scopes) == 0 {
+		return 0, fmt.Errorf("A token needs at least one scope")
+	}
+	for _, scope := range req.Scopes {
+		if !validTokenScope(scope) {
+			return 0, fmt.Errorf("Unknown scope %q, must be read, write, delete or admin", scope)
+		}
+	}
+	if req.Cache != nil && *req.Cache != "" && !cacheNameRegex.MatchString(*req.Cache) {
+		return 0, fmt.Errorf("Invalid cache name %q", *req.Cache)
+	}
+	if req.Name != nil {
+		_, err := path.Match(*req.Name, "")
+		if err != nil {
+			return 0, fmt.Errorf("Invalid name pattern %q: %w", *req.Name, err)
+		}
+	}
+	if req.Ttl == nil {
+		return 24 * time.Hour, nil
+	}
+	ttl, err := time.ParseDuration(*req.Ttl)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid ttl: %w", err)
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("The ttl must be positive")
+	}
+	return ttl, nil
+}
+
+// checkDelegation checks that a token requested by the holder of t grants
+// no more than t: no other scopes, no later expiry and the same limits.
+func (t *Token) checkDelegation(req api.TokenRequest, ttl time.Duration) error {
+	for _, scope := range req.Scopes {
+		if !t.hasScope(scope) {
+			return fmt.Errorf("Token %s lacks the %s scope", t.Id, scope)
+		}
+	}
+	if time.Now().Add(ttl).After(t.Expires) {
+		return fmt.Errorf("Token %s expires at %s, before the requested token", t.Id, t.Expires)
+	}
+	if t.Name != nil && (req.Name == nil || *req.Name != *t.Name) {
+		return fmt.Errorf("Token %s is limited to %s", t.Id, *t.Name)
+	}
+	if t.Cache != nil && (req.Cache == nil || *req.Cache != *t.Cache) {
+		return fmt.Errorf("Token %s is limited to cache %s", t.Id, *t.Cache)
+	}
+	return nil
+}
+
+// Create mints a token and returns its secret, which isn't stored.
+func (s *TokenStore) Create(req api.TokenRequest) (string, api.TokenInfo, error) {
+	ttl, err := checkTokenRequest(req)
+	if err != nil {
+		return "", api.TokenInfo{}, err
+	}
+
+	random := make([]byte, 40)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", api.TokenInfo{}, err
+	}
+	id, secret := hex.EncodeToString(random[:8]), hex.EncodeToString(random[8:])
+	sum := sha256.Sum256([]byte(secret))
+	now := time.Now().UTC().Truncate(time.Second)
+	token := Token{
+		TokenInfo: api.TokenInfo{
+			Id:          id,
+			Scopes:      req.Scopes,
+			Name:        req.Name,
+			Description: req.Description,
+			Created:     now,
+			Expires:     now.Add(ttl),
+		},
+		Hash: hex.EncodeToString(sum[:]),
+	}
+	if req.Cache != nil && *req.Cache != "" {
+		token.Cache = req.Cache
+	}
+
+	err = os.MkdirAll(s.dir, 0770)
+	if err != nil {
+		return "", api.TokenInfo{}, err
+	}
+	s.removeExpired()
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", api.TokenInfo{}, err
+	}
+	err = StoreUpload(s.file(id), bytes.NewReader(data))
+	if err != nil {
+		return "", api.TokenInfo{}, err
+	}
+	return tokenPrefix + id + "_" + secret, token.TokenInfo, nil
+}
+
+func (s *TokenStore) file(id string) string {
+	return s.dir + "/" + id + ".json"
+}
+
+func (s *TokenStore) read(id string) (*Token, error) {
+	data, err := os.ReadFile(s.file(id))
+	if err != nil {
+		return nil, err
+	}
+	token := &Token{}
+	err = json.Unmarshal(data, token)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token file %s: %w", s.file(id), err)
+	}
+	return token, nil
+}
+
+// Verify returns the token of a secret unless it's unknown, revoked or
+// expired.
+func (s *TokenStore) Verify(secret string) (*Token, error) {
+	rest, ok := strings.CutPrefix(secret, tokenPrefix)
+	id, secret, ok2 := strings.Cut(rest, "_")
+	if !ok || !ok2 || !tokenIDRegex.MatchString(id) {
+		return nil, ErrInvalidToken
+	}
+	token, err := s.read(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(secret))
+	hash, err := hex.DecodeString(token.Hash)
+	if err != nil || subtle.ConstantTimeCompare(sum[:], hash) != 1 {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().After(token.Expires) {
+		return nil, fmt.Errorf("%w: token %s expired at %s", ErrInvalidToken, id, token.Expires)
+	}
+	return token, nil
+}
+
+// List returns the tokens that haven't expired, of a single cache if cache
+// isn't empty.
+func (s *TokenStore) List(cache string) ([]api.TokenInfo, error) {
+	s.removeExpired()
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []api.TokenInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	infos := []api.TokenInfo{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !tokenIDRegex.MatchString(id) {
+			continue
+		}
+		token, err := s.read(id)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cache != "" && (token.Cache == nil || *token.Cache != cache) {
+			continue
+		}
+		infos = append(infos, token.TokenInfo)
+	}
+	slices.SortFunc(infos, func(a, b api.TokenInfo) int { return a.Created.Compare(b.Created) })
+	return infos, nil
+}
+
+// Revoke removes a token, of a single cache if cache isn't empty.
+func (s *TokenStore) Revoke(id string, cache string) error {
+	if !tokenIDRegex.MatchString(id) {
+		return os.ErrNotExist
+	}
+	if cache != "" {
+		token, err := s.read(id)
+		if err != nil {
+			return err
+		}
+		if token.Cache == nil || *token.Cache != cache {
+			return os.ErrNotExist
+		}
+	}
+	return os.Remove(s.file(id))
+}
+
+// removeExpired removes the files of expired tokens, they are rejected
+// anyway.
+func (s *TokenStore) removeExpired() {
+	entries, _ := os.ReadDir(s.dir)
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !tokenIDRegex.MatchString(id) {
+			continue
+		}
+		token, err := s.read(id)
+		if err == nil && time.Now().After(token.Expires) {
+			os.Remove(s.file(id))
+		}
+	}
+}
+
+// scopeIncludes reports whether a scope includes another one, like roles
+// do: admin includes all scopes, write and delete include read.
+func scopeIncludes(have api.TokenScope, want api.TokenScope) bool {
+	switch have {
+	case api.Admin:
+		return true
+	case api.Write, api.Delete:
+		return want == have || want == api.Read
+	}
+	return want == have
+}
+
+// hasScope reports whether one of the scopes of a token includes scope.
+func (t *Token) hasScope(scope api.TokenScope) bool {
+	return slices.ContainsFunc(t.Scopes, func(have api.TokenScope) bool { return scopeIncludes(have, scope) })
+}
+
+// allows reports whether a token may do an operation of scope on a cache.
+func (t *Token) allows(scope api.TokenScope, cache string) error {
+	if t.Cache != nil && *t.Cache != cache {
+		return fmt.Errorf("Token %s isn't valid for this cache", t.Id)
+	}
+	if !t.hasScope(scope) {
+		return fmt.Errorf("Token %s needs the %s scope", t.Id, scope)
+	}
+	return nil
+}
+
+// ErrFileHashMismatch is returned by uploads of NARs that don't match the
+// hash in their file name.
+var ErrFileHashMismatch = errors.New("NAR doesn't match its file name")
+
+// fileHashReader fails at the end of a NAR that doesn't match the sha256 in
+// its file name, so the upload isn't stored.
+type fileHashReader struct {
+	r        io.Reader
+	fileHash string
+	hash     hash.Hash
+}
+
+// newFileHashReader checks body against fileHash, which has to be a nix
+// base32 sha256 like nix uses for NAR file names.
+func newFileHashReader(fileHash string, body io.Reader) (io.Reader, error) {
+	if len(fileHash) != 52 {
+		return nil, fmt.Errorf("NAR %s isn't named after its sha256", fileHash)
+	}
+	return &fileHashReader{r: body, fileHash: fileHash, hash: sha256.New()}, nil
+}
+
+func (f *fileHashReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	f.hash.Write(p[:n])
+	if err == io.EOF && nixBase32(f.hash.Sum(nil)) != f.fileHash {
+		return n, fmt.Errorf("%w %s", ErrFileHashMismatch, f.fileHash)
+	}
+	return n, err
+}
+
+// checkName checks uploads of a token with a name pattern against it.
+// Narinfos are read to find their store path, so the returned request
+// has to be used instead of the given one. Uploads that can't be tied to a
+// store path name are rejected.
+func (t *Token) checkName(operationID string, request interface{}, storePath string) (interface{}, error) {
+	if t.Name == nil || operationScope(operationID) != api.Write {
+		return request, nil
+	}
+	pattern := *t.Name
+	match := func(name string) error {
+		ok, _ := path.Match(pattern, name)
+		if !ok {
+			return fmt.Errorf("Token %s may not upload %s", t.Id, name)
+		}
+		return nil
+	}
+	// existing narinfos must not be changed through the listing of another
+	// path
+	matchStored := func(storePathHash string) error {
+		file, err := os.Open(fmt.Sprintf("%s/%s.narinfo", storePath, storePathHash))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := ParseNarInfo(file)
+		if err != nil {
+			return err
+		}
+		_, name, _ := strings.Cut(path.Base(info.StorePath), "-")
+		return match(name)
+	}
+
+	switch req := request.(type) {
+	case api.PutNarFileHashNarCompressionRequestObject:
+		// NARs are only reachable through narinfos, but the NAR of another
+		// path must not be overwritten
+		body, err := newFileHashReader(req.FileHash, req.Body)
+		req.Body = body
+		return req, err
+	case api.PutUncompressedNarRequestObject:
+		body, err := newFileHashReader(req.FileHash, req.Body)
+		req.Body = body
+		return req, err
+	case api.PutStorePathHashLsRequestObject:
+		return request, matchStored(req.StorePathHash)
+	case api.PutLogDeriverRequestObject:
+		_, name, _ := strings.Cut(req.Deriver, "-")
+		return request, match(strings.TrimSuffix(name, ".drv"))
+	case api.PutStorePathHashNarinfoRequestObject:
+		data, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+		if err != nil {
+			return nil, err
+		}
+		info, err := ParseNarInfo(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		hash, name, _ := strings.Cut(path.Base(info.StorePath), "-")
+		if hash != req.StorePathHash {
+			return nil, fmt.Errorf("Narinfo of %s uploaded as %s", info.StorePath, req.StorePathHash)
+		}
+		err = match(name)
+		if err != nil {
+			return nil, err
+		}
+		err = matchStored(req.StorePathHash)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = bytes.NewReader(data)
+		return req, nil
+	}
+	return nil, fmt.Errorf("Token %s is limited to %s and may not use %s", t.Id, pattern, operationID)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChrisOboe/nix-stored/api"
+)
+
+func TestCheckDelegation(t *testing.T) {
+	name, cache, other := "myproj-*", "team-a", "*"
+	caller := &Token{TokenInfo: api.TokenInfo{
+		Id:      "3f2a9c4e1b7d8e6f",
+		Scopes:  []api.TokenScope{api.Write},
+		Name:    &name,
+		Cache:   &cache,
+		Expires: time.Now().Add(time.Hour),
+	}}
+	tests := []struct {
+		name string
+		req  api.TokenRequest
+		ttl  time.Duration
+		ok   bool
+	}{
+		{"subset", api.TokenRequest{Scopes: []api.TokenScope{api.Read}, Name: &name, Cache: &cache}, time.Minute, true},
+		{"same", api.TokenRequest{Scopes: []api.TokenScope{api.Read, api.Write}, Name: &name, Cache: &cache}, 59 * time.Minute, true},
+		{"more scopes", api.TokenRequest{Scopes: []api.TokenScope{api.Admin}, Name: &name, Cache: &cache}, time.Minute, false},
+		{"other scope", api.TokenRequest{Scopes: []api.TokenScope{api.Delete}, Name: &name, Cache: &cache}, time.Minute, false},
+		{"later expiry", api.TokenRequest{Scopes: []api.TokenScope{api.Read}, Name: &name, Cache: &cache}, 2 * time.Hour, false},
+		{"no name", api.TokenRequest{Scopes: []api.TokenScope{api.Read}, Cache: &cache}, time.Minute, false},
+		{"other name", api.TokenRequest{Scopes: []api.TokenScope{api.Read}, Name: &other, Cache: &cache}, time.Minute, false},
+		{"no cache", api.TokenRequest{Scopes: []api.TokenScope{api.Read}, Name: &name}, time.Minute, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := caller.checkDelegation(test.req, test.ttl)
+			if (err == nil) != test.ok {
+				t.Errorf("got %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	tests := []struct {
+		have []api.TokenScope
+		need api.TokenScope
+		ok   bool
+	}{
+		{[]api.TokenScope{api.Admin}, api.Read, true},
+		{[]api.TokenScope{api.Admin}, api.Delete, true},
+		{[]api.TokenScope{api.Write}, api.Read, true},
+		{[]api.TokenScope{api.Delete}, api.Read, true},
+		{[]api.TokenScope{api.Read}, api.Write, false},
+		{[]api.TokenScope{api.Write}, api.Delete, false},
+		{[]api.TokenScope{api.Write, api.Delete}, api.Admin, false},
+	}
+	for _, test := range tests {
+		token := &Token{TokenInfo: api.TokenInfo{Id: "3f2a9c4e1b7d8e6f", Scopes: test.have}}
+		err := token.allows(test.need, "")
+		if (err == nil) != test.ok {
+			t.Errorf("%v needing %s: got %v, want ok %v", test.have, test.need, err, test.ok)
+		}
+	}
+}
+
+func TestCheckNameNar(t *testing.T) {
+	name := "myproj-*"
+	token := &Token{TokenInfo: api.TokenInfo{Id: "3f2a9c4e1b7d8e6f", Scopes: []api.TokenScope{api.Write}, Name: &name}}
+	nar := []byte("not really a NAR")
+	sum := sha256.Sum256(nar)
+	fileHash := nixBase32(sum[:])
+
+	for body, want := range map[string]error{string(nar): nil, "something else": ErrFileHashMismatch} {
+		request, err := token.checkName("PutUncompressedNar", api.PutUncompressedNarRequestObject{FileHash: fileHash, Body: strings.NewReader(body)}, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(request.(api.PutUncompressedNarRequestObject).Body)
+		if !errors.Is(err, want) {
+			t.Errorf("got %v, want %v", err, want)
+		}
+	}
+
+	_, err := token.checkName("PutUncompressedNar", api.PutUncompressedNarRequestObject{FileHash: fileHash[:32], Body: strings.NewReader("")}, t.TempDir())
+	if err == nil {
+		t.Error("NAR not named after its sha256 was accepted")
+	}
+}
+
+func TestCheckNameNarinfo(t *testing.T) {
+	name := "myproj-*"
+	token := &Token{TokenInfo: api.TokenInfo{Id: "3f2a9c4e1b7d8e6f", Scopes: []api.TokenScope{api.Write}, Name: &name}}
+	storePath := t.TempDir()
+	hash := "p4pclmv1gyja5kzc26npqpia1qqxrf0l"
+	narinfo := func(name string) string {
+		return "StorePath: /nix/store/" + hash + "-" + name + "\nURL: nar/x.nar\nCompression: none\nNarHash: sha256:1impfw8zdgisxkghq9a3q7cn7jb9zyzgxdydiamp8z2nlyyl0h5h\nNarSize: 1\nReferences: \n"
+	}
+	put := func() error {
+		_, err := token.checkName("PutStorePathHashNarinfo", api.PutStorePathHashNarinfoRequestObject{StorePathHash: hash, Body: strings.NewReader(narinfo("myproj-1.0"))}, storePath)
+		return err
+	}
+
+	err := put()
+	if err != nil {
+		t.Fatalf("new narinfo of a matching path was rejected: %v", err)
+	}
+	err = os.WriteFile(storePath+"/"+hash+".narinfo", []byte(narinfo("ruby-2.7.3")), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = put()
+	if err == nil {
+		t.Error("narinfo of another path was replaced")
+	}
+}
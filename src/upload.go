@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// temporary files are hidden and start with one of these prefixes
+var tempFilePrefixes = []string{".upload-", ".recompress-", ".narinfo-", ".closure-"}
+
+// StoreUpload writes an uploaded body to filename. The body goes to a
+// temporary file first, so aborted uploads never leave a partial file that
+// would be served later.
+func StoreUpload(filename string, body io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(tmp, body)
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0660)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// RemoveStaleTempFiles removes the temporary files and directories a killed
+// process left behind in dir.
+func RemoveStaleTempFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		for _, prefix := range tempFilePrefixes {
+			if (entry.Type().IsRegular() || entry.IsDir()) && strings.HasPrefix(entry.Name(), prefix) {
+				slog.Info("Removing stale temporary file", "file", filepath.Join(dir, entry.Name()))
+				err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// StoreNarInfo writes a narinfo to filename.
+func StoreNarInfo(filename string, data []byte) error {
+	idx := narIndexOf(filepath.Dir(filename))
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return replaceNarInfo(idx, filename, nil, data)
+}
+
+// replaceNarInfo writes data to filename if it still contains old, or
+// anyway if old is nil. idx is the index of the store, its lock must be
+// held.
+func replaceNarInfo(idx *narIndex, filename string, old []byte, data []byte) error {
+	if old != nil {
+		current, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(current, old) {
+			return fmt.Errorf("%s was changed in the meantime", filepath.Base(filename))
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".narinfo-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0660)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		return err
+	}
+	idx.set(strings.TrimSuffix(filepath.Base(filename), ".narinfo"), data)
+	return nil
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var storePathHashRegex = regexp.MustCompile(`^[0-9a-df-np-sv-z]{32}$`)
+
+// Upstream is a binary cache missing paths are fetched from. If Keys is
+// set, narinfos need a signature by one of them.
+type Upstream struct {
+	URL  *url.URL
+	Keys PublicKeys
+}
+
+func (u Upstream) String() string {
+	return u.URL.Redacted()
+}
+
+// ParseUpstreams parses a space separated list of binary cache urls, in the
+// same format as the substituters setting of nix. Trusted keys of an
+// upstream are given as comma separated trusted-public-keys parameter, e.g.
+// https://cache.nixos.org?trusted-public-keys=cache.nixos.org-1:6NCH...
+func ParseUpstreams(s string) ([]Upstream, error) {
+	var upstreams []Upstream
+	for _, field := range strings.Fields(s) {
+		u, err := url.Parse(field)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("Unsupported upstream %q, only http and https are supported", field)
+		}
+
+		upstream := Upstream{}
+		// url.ParseQuery would turn the + of base64 into spaces
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			key, value, _ := strings.Cut(param, "=")
+			switch key {
+			case "":
+			case "trusted-public-keys":
+				value, err = url.PathUnescape(value)
+				if err != nil {
+					return nil, err
+				}
+				upstream.Keys, err = ParsePublicKeys(strings.ReplaceAll(value, ",", " "))
+				if err != nil {
+					return nil, fmt.Errorf("Couldn't parse trusted public keys of %s: %w", u.Redacted(), err)
+				}
+			default:
+				return nil, fmt.Errorf("Unsupported parameter %q of upstream %s", key, u.Redacted())
+			}
+		}
+		u.RawQuery = ""
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		upstream.URL = u
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// Proxy fetches narinfos and NARs missing in a cache from upstream caches
+// and stores them in the cache. Nothing is stored or served before it is
+// verified. Each cache has one proxy, shared by requests, prefetches and
+// syncs, so they share downloads.
+type Proxy struct {
+	storePath   string
+	upstreams   []Upstream
+	negativeTTL time.Duration
+	client      *http.Client
+	// ctx aborts downloads when the server stops
+	ctx context.Context
+	// narStored is called for every NAR stored in the cache
+	narStored func(narFile string)
+
+	narinfos singleflight.Group
+
+	mu        sync.Mutex
+	running   sync.WaitGroup
+	downloads map[string]*narDownload
+	missing   map[string]time.Time
+	swept     time.Time
+}
+
+// NewProxy creates the proxy of a cache. Downloads are aborted when ctx is
+// done.
+func NewProxy(ctx context.Context, storePath string, upstreams []Upstream, negativeTTL time.Duration, narStored func(narFile string)) *Proxy {
+	return &Proxy{
+		storePath:   storePath,
+		upstreams:   upstreams,
+		negativeTTL: negativeTTL,
+		client:      &http.Client{},
+		ctx:         ctx,
+		narStored:   narStored,
+		downloads:   map[string]*narDownload{},
+		missing:     map[string]time.Time{},
+	}
+}
+
+// timeout for fetching a narinfo from an upstream
+const narInfoTimeout = 30 * time.Second
+
+// HasUpstreams tells whether missing paths are fetched from upstreams.
+func (p *Proxy) HasUpstreams() bool {
+	return len(p.upstreams) > 0
+}
+
+func (p *Proxy) get(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "nix-stored")
+	return p.client.Do(req)
+}
+
+// pendingNar is what we need to fetch a NAR after its narinfo was fetched.
+// It's stored in the upstream directory, named like the NAR, until the NAR
+// is stored.
+type pendingNar struct {
+	URL     string `json:"url"`
+	NarInfo string `json:"narinfo"`
+}
+
+// FetchNarInfo returns the narinfo of storePathHash from the first upstream
+// that has it, with the URL of the NAR rewritten to point to this cache. The
+// narinfo is only stored once its NAR was fetched and verified. It returns
+// os.ErrNotExist if no upstream has the narinfo. Concurrent fetches of the
+// same narinfo are only done once and misses are remembered for a while.
+func (p *Proxy) FetchNarInfo(storePathHash string) (string, error) {
+	if !storePathHashRegex.MatchString(storePathHash) || p.isMissing(storePathHash) {
+		return "", os.ErrNotExist
+	}
+	info, err, _ := p.narinfos.Do(storePathHash, func() (interface{}, error) {
+		return p.fetchNarInfo(storePathHash)
+	})
+	if err != nil {
+		return "", err
+	}
+	return info.(string), nil
+}
+
+func (p *Proxy) isMissing(storePathHash string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expiry, ok := p.missing[storePathHash]
+	return ok && time.Now().Before(expiry)
+}
+
+func (p *Proxy) setMissing(storePathHash string) {
+	if p.negativeTTL == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.Sub(p.swept) > p.negativeTTL {
+		for hash, expiry := range p.missing {
+			if now.After(expiry) {
+				delete(p.missing, hash)
+			}
+		}
+		p.swept = now
+	}
+	p.missing[storePathHash] = now.Add(p.negativeTTL)
+}
+
+func (p *Proxy) fetchNarInfo(storePathHash string) (string, error) {
+	failed := false
+	for _, upstream := range p.upstreams {
+		info, narURL, err := p.fetchNarInfoFrom(upstream, storePathHash)
+		if err != nil {
+			slog.Warn("Couldn't fetch narinfo from upstream", "upstream", upstream, "storepathhash", storePathHash, "error", err)
+			failed = true
+			continue
+		}
+		if info == nil {
+			continue
+		}
+
+		narFile, err := p.storePending(info, narURL)
+		if err != nil {
+			return "", err
+		}
+		// the NAR was verified for another narinfo with the same FileHash
+		_, err = os.Stat(p.storePath + "/nar/" + narFile)
+		if err == nil {
+			err = p.storeNarInfo(storePathHash, info, narFile)
+			if err != nil {
+				return "", err
+			}
+		}
+		slog.Info("Fetched narinfo from upstream", "upstream", upstream, "storepathhash", storePathHash)
+		local := *info
+		local.URL = "nar/" + narFile
+		return local.String(), nil
+	}
+	// don't remember misses caused by a broken upstream
+	if !failed {
+		p.setMissing(storePathHash)
+	}
+	return "", os.ErrNotExist
+}
+
+// Wait waits for all NAR downloads to finish.
+func (p *Proxy) Wait() {
+	p.running.Wait()
+}
+
+// storePending remembers where to fetch the NAR of info from and returns
+// its file name.
+func (p *Proxy) storePending(info *NarInfo, narURL *url.URL) (string, error) {
+	narFile := path.Base(narURL.Path)
+	data, err := json.Marshal(pendingNar{URL: narURL.String(), NarInfo: info.String()})
+	if err != nil {
+		return "", err
+	}
+	return narFile, os.WriteFile(p.storePath+"/upstream/"+narFile, data, 0660)
+}
+
+// storeNarInfo stores info with the URL pointing to narFile in this cache.
+func (p *Proxy) storeNarInfo(storePathHash string, info *NarInfo, narFile string) error {
+	local := *info
+	local.URL = "nar/" + narFile
+	return StoreNarInfo(fmt.Sprintf("%s/%s.narinfo", p.storePath, storePathHash), []byte(local.String()))
+}
+
+// pull stores a path fetched with fetchNarInfoFrom. Like with FetchNarInfo,
+// the narinfo is only stored after its NAR, so it never points to a NAR that
+// can't be fetched. pull returns early if ctx is done first, the download
+// goes on and stores the narinfo once the NAR is verified.
+func (p *Proxy) pull(ctx context.Context, storePathHash string, info *NarInfo, narURL *url.URL) error {
+	pendingFile := p.storePath + "/upstream/" + path.Base(narURL.Path)
+	// a narinfo fetched by FetchNarInfo may need the pending NAR later
+	_, err := os.Stat(pendingFile)
+	ownPending := os.IsNotExist(err)
+	narFile, err := p.storePending(info, narURL)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(p.storePath + "/nar/" + narFile)
+	if os.IsNotExist(err) {
+		var nar io.ReadCloser
+		nar, _, err = p.OpenNar(narFile)
+		if err != nil {
+			return err
+		}
+		// the download goes on without us
+		stop := context.AfterFunc(ctx, func() { nar.Close() })
+		_, err = io.Copy(io.Discard, nar)
+		if stop() {
+			nar.Close()
+		}
+	} else if err == nil {
+		os.Remove(pendingFile)
+	}
+	if err != nil {
+		if ownPending {
+			os.Remove(pendingFile)
+		}
+		return err
+	}
+	return p.storeNarInfo(storePathHash, info, narFile)
+}
+
+// fetchNarInfoFrom returns the verified narinfo and the absolute url of its
+// NAR, or nil if the upstream doesn't have it.
+func (p *Proxy) fetchNarInfoFrom(upstream Upstream, storePathHash string) (*NarInfo, *url.URL, error) {
+	ctx, cancel := context.WithTimeout(p.ctx, narInfoTimeout)
+	defer cancel()
+	resp, err := p.get(ctx, upstream.URL.JoinPath(storePathHash+".narinfo"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	// S3 answers 403 for missing objects
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
+		return nil, nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	info, err := ParseNarInfo(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasPrefix(path.Base(info.StorePath), storePathHash+"-") {
+		return nil, nil, fmt.Errorf("Narinfo is for %s", info.StorePath)
+	}
+	if len(upstream.Keys) > 0 && !upstream.Keys.VerifyAny(info.Fingerprint(), info.Sigs) {
+		return nil, nil, fmt.Errorf("Narinfo of %s has no valid signature", info.StorePath)
+	}
+	narURL, err := upstream.URL.JoinPath("/").Parse(info.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := parseNarFile(path.Base(narURL.Path)); !ok {
+		return nil, nil, fmt.Errorf("Unsupported NAR url %q", info.URL)
+	}
+	return info, narURL, nil
+}
+
+// parseNarFile checks the file name of a NAR and returns its compression,
+// which is empty for uncompressed NARs.
+func parseNarFile(narFile string) (string, bool) {
+	fileHash, ext, _ := strings.Cut(narFile, ".nar")
+	compression, found := strings.CutPrefix(ext, ".")
+	if ext != "" && !found {
+		return "", false
+	}
+	return compression, ValidNarFile(fileHash, compression)
+}
+
+// OpenNar fetches a NAR whose narinfo was fetched before and stores it in
+// the cache. The returned reader streams the NAR while it's downloaded,
+// concurrent requests for the same NAR share the download. The end of the
+// NAR is held back until it's verified, so clients never get a complete
+// unverified NAR. size is -1 if the upstream doesn't tell. It returns
+// os.ErrNotExist if there is no such NAR upstream.
+func (p *Proxy) OpenNar(narFile string) (io.ReadCloser, int64, error) {
+	if _, ok := parseNarFile(narFile); !ok {
+		return nil, 0, os.ErrNotExist
+	}
+
+	p.mu.Lock()
+	d, ok := p.downloads[narFile]
+	if !ok {
+		d = &narDownload{size: -1}
+		d.cond = sync.NewCond(&d.mu)
+		p.downloads[narFile] = d
+		p.running.Add(1)
+		go p.download(narFile, d)
+	}
+	p.mu.Unlock()
+	return d.open(p.storePath + "/nar/" + narFile)
+}
+
+func (p *Proxy) download(narFile string, d *narDownload) {
+	defer p.running.Done()
+	defer func() {
+		p.mu.Lock()
+		delete(p.downloads, narFile)
+		p.mu.Unlock()
+	}()
+
+	commit, err := p.fetchNar(narFile, d)
+	err = d.finish(err, commit)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Couldn't fetch NAR from upstream", "file", narFile, "error", err)
+		}
+		return
+	}
+	os.Remove(p.storePath + "/upstream/" + narFile)
+	slog.Info("Fetched NAR from upstream", "file", narFile, "size", d.written)
+	p.narStored(narFile)
+}
+
+// fetchNar downloads and verifies a NAR. It returns a function that moves
+// the NAR into place and stores its narinfo.
+func (p *Proxy) fetchNar(narFile string, d *narDownload) (func() error, error) {
+	data, err := os.ReadFile(p.storePath + "/upstream/" + narFile)
+	if err != nil {
+		return nil, err
+	}
+	var pending pendingNar
+	err = json.Unmarshal(data, &pending)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ParseNarInfo(strings.NewReader(pending.NarInfo))
+	if err != nil {
+		return nil, err
+	}
+	narURL, err := url.Parse(pending.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.get(p.ctx, narURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	if info.FileSize > 0 && resp.ContentLength >= 0 && uint64(resp.ContentLength) != info.FileSize {
+		return nil, fmt.Errorf("Upstream sent %d bytes instead of %d", resp.ContentLength, info.FileSize)
+	}
+
+	tmp, err := os.CreateTemp(p.storePath+"/nar", ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+	d.start(tmp.Name(), resp.ContentLength)
+
+	// the NAR is decompressed on the fly to check the NarHash
+	pr, pw := io.Pipe()
+	narHash := make(chan error, 1)
+	uncompressed := &countingWriter{hash: sha256.New()}
+	go func() {
+		r, err := decompressNar(pr, info.Compression)
+		if err == nil {
+			_, err = io.Copy(uncompressed, r)
+			r.Close()
+		}
+		pr.CloseWithError(err)
+		narHash <- err
+	}()
+
+	compressed := &countingWriter{hash: sha256.New()}
+	w := io.MultiWriter(tmp, compressed, pw)
+	buf := make([]byte, 256*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			_, werr := w.Write(buf[:n])
+			if werr != nil {
+				pw.CloseWithError(werr)
+				return nil, werr
+			}
+			d.progress(int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			return nil, err
+		}
+	}
+	pw.Close()
+	err = <-narHash
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decompress NAR: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.FileHash != "" && (!hashMatches(info.FileHash, compressed.hash.Sum(nil)) || compressed.size != info.FileSize) {
+		return nil, fmt.Errorf("NAR doesn't match the FileHash of %s", info.StorePath)
+	}
+	if !hashMatches(info.NarHash, uncompressed.hash.Sum(nil)) || uncompressed.size != info.NarSize {
+		return nil, fmt.Errorf("NAR doesn't match the NarHash of %s", info.StorePath)
+	}
+
+	filename := p.storePath + "/nar/" + narFile
+	return func() error {
+		err := os.Chmod(tmp.Name(), 0660)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp.Name(), filename)
+		if err != nil {
+			return err
+		}
+		storePathHash, _, _ := strings.Cut(path.Base(info.StorePath), "-")
+		return p.storeNarInfo(storePathHash, info, narFile)
+	}, nil
+}
+
+// narDownload is a NAR that is being downloaded to a temporary file.
+// Readers follow the file while it grows.
+type narDownload struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	tmpName string
+	size    int64
+	written int64
+	started bool
+	done    bool
+	err     error
+}
+
+func (d *narDownload) start(tmpName string, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tmpName = tmpName
+	d.size = size
+	d.started = true
+	d.cond.Broadcast()
+}
+
+func (d *narDownload) progress(n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.written += n
+	d.cond.Broadcast()
+}
+
+// finish ends the download. commit moves the finished file into place, it
+// runs with the lock held so readers never miss the file.
+func (d *narDownload) finish(err error, commit func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil && commit != nil {
+		err = commit()
+	}
+	if err != nil && d.tmpName != "" {
+		os.Remove(d.tmpName)
+	}
+	d.err = err
+	d.done = true
+	d.cond.Broadcast()
+	return err
+}
+
+// readable returns how much of the download may be read. The last byte is
+// only readable after the download was verified.
+func (d *narDownload) readable() int64 {
+	if d.done && d.err == nil {
+		return d.written
+	}
+	return max(d.written-1, 0)
+}
+
+// open waits until the download started and opens the file. filename is
+// where the finished download is stored.
+func (d *narDownload) open(filename string) (io.ReadCloser, int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for !d.started && !d.done {
+		d.cond.Wait()
+	}
+	if d.err != nil {
+		return nil, 0, d.err
+	}
+	if d.done {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, 0, err
+		}
+		return file, d.written, nil
+	}
+	file, err := os.Open(d.tmpName)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &downloadReader{d: d, file: file}, d.size, nil
+}
+
+type downloadReader struct {
+	d      *narDownload
+	file   *os.File
+	offset int64
+}
+
+func (r *downloadReader) Read(p []byte) (int, error) {
+	r.d.mu.Lock()
+	for r.offset >= r.d.readable() && !r.d.done {
+		r.d.cond.Wait()
+	}
+	available := r.d.readable() - r.offset
+	err := r.d.err
+	r.d.mu.Unlock()
+
+	if available <= 0 {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := r.file.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *downloadReader) Close() error {
+	return r.file.Close()
+}
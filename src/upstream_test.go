@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testUpstreamHash = "p4pclmv1gyja5kzc26npqpia1qqxrf0l"
+
+// testUpstream serves files like a binary cache and counts the requests.
+type testUpstream struct {
+	files    map[string]string
+	requests atomic.Int32
+}
+
+func (u *testUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.requests.Add(1)
+	data, ok := u.files[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	io.WriteString(w, data)
+}
+
+// start serves the upstream. Its narinfos need a signature by one of keys.
+func (u *testUpstream) start(t *testing.T, keys PublicKeys) Upstream {
+	server := httptest.NewServer(u)
+	t.Cleanup(server.Close)
+	URL, _ := url.Parse(server.URL)
+	return Upstream{URL: URL, Keys: keys}
+}
+
+// testUpstreamPath returns the files of an upstream having a path whose
+// narinfo is signed with key, and the NAR.
+func testUpstreamPath(key *SecretKey) (map[string]string, []byte) {
+	nar := testNar(narMagic, "(", "type", "regular", "contents", uint64(5), []byte("hello"), ")")
+	sum := sha256.Sum256(nar)
+	hash := nixBase32(sum[:])
+	info := &NarInfo{
+		StorePath:   "/nix/store/" + testUpstreamHash + "-hello",
+		URL:         "nar/" + hash + ".nar",
+		Compression: "none",
+		FileHash:    "sha256:" + hash,
+		FileSize:    uint64(len(nar)),
+		NarHash:     "sha256:" + hash,
+		NarSize:     uint64(len(nar)),
+	}
+	info.Sigs = []string{key.Sign(info.Fingerprint())}
+	return map[string]string{
+		"/" + testUpstreamHash + ".narinfo": info.String(),
+		"/" + info.URL:                      string(nar),
+	}, nar
+}
+
+func testSecretKey(t *testing.T, name string) (*SecretKey, PublicKeys) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SecretKey{Name: name, Key: private}, PublicKeys{name: public}
+}
+
+func testProxy(t *testing.T, upstreams ...Upstream) *Proxy {
+	storePath := t.TempDir()
+	err := createStoreDirs(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewProxy(ctx, storePath, upstreams, 0, func(narFile string) {})
+	t.Cleanup(func() {
+		cancel()
+		p.Wait()
+	})
+	return p
+}
+
+// fetchPath fetches the narinfo and the NAR of the test path through p.
+func fetchPath(p *Proxy) ([]byte, error) {
+	text, err := p.FetchNarInfo(testUpstreamHash)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ParseNarInfo(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	nar, _, err := p.OpenNar(info.URL[len("nar/"):])
+	if err != nil {
+		return nil, err
+	}
+	defer nar.Close()
+	return io.ReadAll(nar)
+}
+
+func TestProxyFallback(t *testing.T) {
+	key, keys := testSecretKey(t, "test-1")
+	files, nar := testUpstreamPath(key)
+	broken := &testUpstream{files: map[string]string{"/" + testUpstreamHash + ".narinfo": "garbage"}}
+	missing := &testUpstream{files: map[string]string{}}
+	good := &testUpstream{files: files}
+	p := testProxy(t, broken.start(t, keys), missing.start(t, keys), good.start(t, keys))
+
+	data, err := fetchPath(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(nar) {
+		t.Errorf("got a NAR of %d bytes, want %d", len(data), len(nar))
+	}
+	if broken.requests.Load() != 1 || missing.requests.Load() != 1 {
+		t.Errorf("the first upstreams weren't asked")
+	}
+	p.Wait()
+	_, err = os.Stat(fmt.Sprintf("%s/%s.narinfo", p.storePath, testUpstreamHash))
+	if err != nil {
+		t.Errorf("narinfo wasn't stored: %v", err)
+	}
+}
+
+func TestProxySignatureRejected(t *testing.T) {
+	otherKey, _ := testSecretKey(t, "test-1")
+	_, keys := testSecretKey(t, "test-1")
+	files, _ := testUpstreamPath(otherKey)
+	forged := &testUpstream{files: files}
+	p := testProxy(t, forged.start(t, keys))
+
+	_, err := fetchPath(p)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v, want the forged path to be missing", err)
+	}
+	if forged.requests.Load() != 1 {
+		t.Errorf("the NAR of the forged path was fetched")
+	}
+	_, err = os.Stat(fmt.Sprintf("%s/%s.narinfo", p.storePath, testUpstreamHash))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("forged narinfo was stored: %v", err)
+	}
+
+	// the next upstream is asked instead
+	key, keys := testSecretKey(t, "test-2")
+	files, nar := testUpstreamPath(key)
+	good := &testUpstream{files: files}
+	p = testProxy(t, forged.start(t, keys), good.start(t, keys))
+	data, err := fetchPath(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(nar) {
+		t.Errorf("got a NAR of %d bytes, want %d", len(data), len(nar))
+	}
+}
+
+func TestProxyTamperedNar(t *testing.T) {
+	key, keys := testSecretKey(t, "test-1")
+	files, nar := testUpstreamPath(key)
+	for file, data := range files {
+		if data == string(nar) {
+			files[file] = "tampered" + data[len("tampered"):]
+		}
+	}
+	p := testProxy(t, (&testUpstream{files: files}).start(t, keys))
+
+	_, err := fetchPath(p)
+	if err == nil {
+		t.Fatal("the tampered NAR was served completely")
+	}
+	p.Wait()
+	_, err = os.Stat(fmt.Sprintf("%s/%s.narinfo", p.storePath, testUpstreamHash))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("narinfo of the tampered NAR was stored: %v", err)
+	}
+}
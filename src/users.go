@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is what a user may do. Every role includes the ones before it.
+type Role int
+
+const (
+	RoleRead Role = iota + 1
+	RoleWrite
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{RoleRead: "read", RoleWrite: "write", RoleAdmin: "admin"}
+
+func ParseRole(s string) (Role, error) {
+	for role, name := range roleNames {
+		if s == name {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown role %q, must be read, write or admin", s)
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+var userNameRegex = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
+// argon2id parameters of new hashes
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+)
+
+// HashPassword hashes a password with bcrypt or argon2id.
+func HashPassword(pass string, scheme string) (string, error) {
+	switch scheme {
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+		return string(hash), err
+	case "argon2id":
+		salt := make([]byte, 16)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(pass), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("Unsupported hash %q, must be bcrypt or argon2id", scheme)
+	}
+}
+
+// checkPasswordHash reports whether pass matches a bcrypt or argon2id hash.
+func checkPasswordHash(hash string, pass string) (bool, error) {
+	if strings.HasPrefix(hash, "$2") {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if strings.HasPrefix(hash, "$argon2id$") {
+		h, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(pass), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		return subtle.ConstantTimeCompare(h.key, other) == 1, nil
+	}
+	return false, fmt.Errorf("Unsupported password hash, must be bcrypt or argon2id")
+}
+
+// limits of the argon2id parameters of user files, so a bad line can't make
+// every login use all memory or CPU
+const (
+	argon2MaxMemory = 1024 * 1024
+	argon2MaxTime   = 100
+	argon2MaxKeyLen = 64
+)
+
+// argon2Hash is a parsed argon2id hash. memory is in KiB.
+type argon2Hash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2Hash parses and checks a hash like
+// $argon2id$v=19$m=65536,t=3,p=4$salt$key.
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[1] != "argon2id" {
+		return argon2Hash{}, fmt.Errorf("Invalid argon2id hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return argon2Hash{}, fmt.Errorf("Unsupported argon2id version %q", fields[2])
+	}
+	var h argon2Hash
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads)
+	if err != nil {
+		return argon2Hash{}, fmt.Errorf("Invalid argon2id parameters %q", fields[3])
+	}
+	if h.threads < 1 || h.time < 1 || h.time > argon2MaxTime || h.memory < 8*uint32(h.threads) || h.memory > argon2MaxMemory {
+		return argon2Hash{}, fmt.Errorf("Unsupported argon2id parameters %q, at most m=%d,t=%d are allowed", fields[3], argon2MaxMemory, argon2MaxTime)
+	}
+	h.salt, err = base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil || len(h.salt) == 0 {
+		return argon2Hash{}, fmt.Errorf("Invalid argon2id salt")
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(h.key) == 0 || len(h.key) > argon2MaxKeyLen {
+		return argon2Hash{}, fmt.Errorf("Invalid argon2id key")
+	}
+	return h, nil
+}
+
+// userEntry is a line of a user file.
+type userEntry struct {
+	name string
+	hash string
+	role Role
+}
+
+// parseUserLine parses a line of a user file, like htpasswd writes them
+// with an optional role: name:hash[:role]. The role defaults to read.
+func parseUserLine(line string) (userEntry, error) {
+	fields := strings.Split(line, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return userEntry{}, fmt.Errorf("Expected name:hash:role")
+	}
+	entry := userEntry{name: fields[0], hash: fields[1], role: RoleRead}
+	if !userNameRegex.MatchString(entry.name) {
+		return userEntry{}, fmt.Errorf("Invalid user name %q", entry.name)
+	}
+	if !strings.HasPrefix(entry.hash, "$2") && !strings.HasPrefix(entry.hash, "$argon2id$") {
+		return userEntry{}, fmt.Errorf("Unsupported password hash of %s, must be bcrypt or argon2id", entry.name)
+	}
+	if strings.HasPrefix(entry.hash, "$argon2id$") {
+		_, err := parseArgon2Hash(entry.hash)
+		if err != nil {
+			return userEntry{}, fmt.Errorf("Password hash of %s: %w", entry.name, err)
+		}
+	}
+	if len(fields) == 3 {
+		var err error
+		entry.role, err = ParseRole(fields[2])
+		if err != nil {
+			return userEntry{}, err
+		}
+	}
+	return entry, nil
+}
+
+func (e userEntry) String() string {
+	return e.name + ":" + e.hash + ":" + e.role.String()
+}
+
+// UserDB are the users of a user file. The file is read again on Reload.
+type UserDB struct {
+	file  string
+	users atomic.Pointer[map[string]userEntry]
+
+	// verified remembers the last password that matched the hash of a
+	// user, so hashing is only needed once and not for every request
+	mu       sync.Mutex
+	verified map[string][32]byte
+}
+
+func LoadUserDB(file string) (*UserDB, error) {
+	d := &UserDB{file: file, verified: map[string][32]byte{}}
+	err := d.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *UserDB) String() string {
+	return d.file
+}
+
+// Reload reads the user file again. The old users stay if it's invalid.
+func (d *UserDB) Reload() error {
+	entries, err := readUserFile(d.file)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]userEntry, len(entries))
+	for _, entry := range entries {
+		users[entry.name] = entry
+	}
+	d.users.Store(&users)
+	d.mu.Lock()
+	clear(d.verified)
+	d.mu.Unlock()
+	return nil
+}
+
+// dummyHash is checked for unknown users, so they take as long as known
+// ones.
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("nix-stored", "bcrypt")
+	return hash
+})
+
+// Authenticate returns the role of a user if the password is right.
+func (d *UserDB) Authenticate(name string, pass string) (Role, bool) {
+	entry, ok := (*d.users.Load())[name]
+	if !ok {
+		checkPasswordHash(dummyHash(), pass)
+		return 0, false
+	}
+
+	sum := sha256.Sum256([]byte(entry.hash + "\x00" + pass))
+	d.mu.Lock()
+	verified, ok := d.verified[name]
+	d.mu.Unlock()
+	if ok && subtle.ConstantTimeCompare(verified[:], sum[:]) == 1 {
+		return entry.role, true
+	}
+
+	match, err := checkPasswordHash(entry.hash, pass)
+	if err != nil || !match {
+		return 0, false
+	}
+	d.mu.Lock()
+	d.verified[name] = sum
+	d.mu.Unlock()
+	return entry.role, true
+}
+
+// readUserFile returns the users of a user file. Empty lines and lines
+// starting with # are ignored.
+func readUserFile(file string) ([]userEntry, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []userEntry
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, err := parseUserLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, i, err)
+		}
+		if seen[entry.name] {
+			return nil, fmt.Errorf("%s:%d: Duplicate user %s", file, i, entry.name)
+		}
+		seen[entry.name] = true
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// updateUserFile changes the line of a user in a user file and keeps all
+// other lines. update gets the current entry, or nil if there is none, and
+// returns the new one, or nil to remove the user. The file is replaced
+// atomically.
+func updateUserFile(file string, name string, update func(entry *userEntry) (*userEntry, error)) error {
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var lines []string
+	var current *userEntry
+	index := -1
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			entry, err := parseUserLine(trimmed)
+			if err == nil && entry.name == name {
+				current = &entry
+				index = len(lines)
+			}
+		}
+		lines = append(lines, line)
+	}
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+
+	entry, err := update(current)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry == nil && index >= 0:
+		lines = append(lines[:index], lines[index+1:]...)
+	case entry != nil && index >= 0:
+		lines[index] = entry.String()
+	case entry != nil:
+		lines = append(lines, entry.String())
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	w := bufio.NewWriter(tmp)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	// keep the permissions of an existing file, hashes are secrets as well
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode().Perm()
+	}
+	err = os.Chmod(tmp.Name(), mode)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// authFile is a file of users or rules that is read again on SIGHUP.
+type authFile interface {
+	Reload() error
+	String() string
+}
+
+// ReloadAuth reads the user, OIDC and client certificate files of all
+// caches again.
+func (s Settings) ReloadAuth() {
+	reloaded := map[authFile]bool{}
+	for _, cs := range append([]CacheSettings{s.CacheSettings}, s.Caches...) {
+		var files []authFile
+		if cs.Users != nil {
+			files = append(files, cs.Users)
+		}
+		if cs.OIDC != nil {
+			files = append(files, cs.OIDC)
+		}
+		if cs.ClientCerts != nil {
+			files = append(files, cs.ClientCerts)
+		}
+		for _, file := range files {
+			if reloaded[file] {
+				continue
+			}
+			reloaded[file] = true
+			err := file.Reload()
+			if err != nil {
+				slog.Error("Couldn't reload file, keeping the old one", "file", file, "error", err)
+				continue
+			}
+			slog.Info("Reloaded file", "file", file)
+		}
+	}
+}
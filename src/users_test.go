@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUserLineArgon2Parameters(t *testing.T) {
+	const hash = "$argon2id$v=19$%s$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5"
+	for params, valid := range map[string]bool{
+		"m=65536,t=3,p=4":      true,
+		"m=65536,t=3,p=0":      false,
+		"m=65536,t=0,p=4":      false,
+		"m=16,t=3,p=4":         false,
+		"m=4294967295,t=3,p=4": false,
+		"m=65536,t=100000,p=4": false,
+	} {
+		_, err := parseUserLine("alice:" + strings.Replace(hash, "%s", params, 1))
+		if (err == nil) != valid {
+			t.Errorf("%s: got %v", params, err)
+		}
+	}
+}